@@ -15,25 +15,76 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"github.com/ccding/go-stun/stun"
 )
 
+// Exit codes.
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitUsage   = 2
+	exitBlocked = 3
+)
+
 func main() {
-	var serverAddr = flag.String("s", stun.DefaultServerAddr, "STUN server address")
-	var localPort = flag.Int("p", 0, "The port on which to bind requests, set to 0 to pick a random port")
-	var localIP = flag.String("i", "", "The ip on which to bind requests, set to empty will use default")
-	var behaviorTestMode = flag.Bool("b", false, "Enable NAT behavior test mode")
-	var verboseLevel = flag.Int("v", 0, "Verbose level (0: none, 1: verbose, 2: double verbose, 3: triple verbose)")
-	flag.Parse()
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// errUsage is returned by the commands whose arguments are invalid, which
+// they have reported.
+var errUsage = errors.New("invalid arguments")
+
+// run runs the command line args, writes the results to stdout and the
+// errors to stderr, and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("go-stun", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var serverAddr = flags.String("s", stun.DefaultServerAddr, "STUN server address")
+	var localPort = flags.Int("p", 0, "The port on which to bind requests, set to 0 to pick a random port")
+	var localIP = flags.String("i", "", "The ip on which to bind requests, set to empty will use default")
+	var behaviorTestMode = flags.Bool("b", false, "Enable NAT behavior test mode")
+	var verboseLevel = flags.Int("v", 0, "Verbose level (0: none, 1: verbose, 2: double verbose, 3: triple verbose)")
+	var format = flags.String("format", "text", "Output format (text, json or yaml)")
+	var pcapFile = flags.String("pcap", "", "Write the STUN packets to the file in the pcapng format")
+	var protocol = flags.String("protocol", "auto", "STUN protocol version (auto, 5389 or 3489)")
+	var strict = flags.Bool("strict", false, "Drop responses from unexpected addresses, and reject unknown required attributes")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
 
 	// Validate verbose level
 	if *verboseLevel < 0 || *verboseLevel > 3 {
-		fmt.Fprintln(os.Stderr, "Error: Invalid verbose level. Use -v with values 0, 1, 2, or 3.")
-		os.Exit(1)
+		fmt.Fprintln(stderr, "Error: Invalid verbose level. Use -v with values 0, 1, 2, or 3.")
+		return exitUsage
+	}
+	// Validate output format
+	if *format != "text" && *format != "json" && *format != "yaml" {
+		fmt.Fprintln(stderr, "Error: Invalid format. Use -format with values text, json, or yaml.")
+		return exitUsage
+	}
+
+	// Validate protocol version
+	protocols := map[string]stun.Protocol{
+		"auto": stun.ProtocolAuto,
+		"5389": stun.ProtocolRFC5389,
+		"3489": stun.ProtocolRFC3489,
+	}
+	if _, ok := protocols[*protocol]; !ok {
+		fmt.Fprintln(stderr, "Error: Invalid protocol. Use -protocol with values auto, 5389, or 3489.")
+		return exitUsage
+	}
+	if cmd := flags.Arg(0); flags.NArg() > 0 && cmd != "ping" && cmd != "check" {
+		fmt.Fprintln(stderr, "Error: Unknown command", cmd)
+		return exitUsage
 	}
 
 	// Create a STUN client
@@ -41,44 +92,167 @@ func main() {
 	client.SetServerAddr(*serverAddr)
 	client.SetLocalPort(*localPort)
 	client.SetLocalIP(*localIP)
+	client.SetProtocol(protocols[*protocol])
+	client.SetStrict(*strict)
 	client.SetVerbose(*verboseLevel >= 1)
 	client.SetVVerbose(*verboseLevel >= 2)
-
-	// Run behavior test if specified
-	if *behaviorTestMode {
-		err := runBehaviorTest(client)
+	if *pcapFile != "" {
+		capture, err := os.Create(*pcapFile)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error:", err)
-			os.Exit(1)
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
 		}
-		return
+		defer func() {
+			if err := capture.Close(); err != nil {
+				fmt.Fprintln(stderr, "Error:", err)
+			}
+		}()
+		client.SetCaptureWriter(capture)
 	}
 
-	// Discover the NAT
-	nat, host, err := client.Discover()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error:", err)
-		os.Exit(1)
+	var r *report
+	var err error
+	switch {
+	case flags.Arg(0) == "ping":
+		r, err = runPing(client, *serverAddr, flags.Args()[1:], stderr)
+	case flags.Arg(0) == "check":
+		r, err = runCheck(client, *serverAddr, flags.Args()[1:], stderr)
+	case *behaviorTestMode:
+		r, err = runBehaviorTest(client, *serverAddr)
+	default:
+		r, err = runDiscover(client, *serverAddr)
 	}
-
-	fmt.Println("NAT Type:", nat)
-	if host != nil {
-		fmt.Println("External IP Family:", host.Family())
-		fmt.Println("External IP:", host.IP())
-		fmt.Println("External Port:", host.Port())
+	if err == errUsage {
+		return exitUsage
 	}
+	if *format == "text" {
+		printText(stdout, stderr, r, err)
+	} else if werr := writeReport(stdout, *format, r); werr != nil {
+		fmt.Fprintln(stderr, "Error:", werr)
+		return exitError
+	}
+	return r.exitCode()
+}
+
+func runDiscover(c *stun.Client, server string) (*report, error) {
+	start := time.Now()
+	result, err := c.DiscoverResult()
+	r := newReport("discover", server, time.Since(start), err)
+	r.setDiscoveryResult(result)
+	return r, err
 }
 
-func runBehaviorTest(c *stun.Client) error {
+func runBehaviorTest(c *stun.Client, server string) (*report, error) {
+	start := time.Now()
 	natBehavior, err := c.BehaviorTest()
+	r := newReport("behavior", server, time.Since(start), err)
+	r.setBehavior(natBehavior)
+	if err == stun.ErrBlocked {
+		r.blocked = true
+	}
+	return r, err
+}
+
+// runPing runs the ping command, whose flags are in args.
+func runPing(c *stun.Client, server string, args []string, stderr io.Writer) (*report, error) {
+	flags := flag.NewFlagSet("ping", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	count := flags.Int("c", 4, "Number of requests to send")
+	interval := flags.Duration("interval", time.Second, "Time between requests")
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if *count <= 0 || flags.NArg() > 0 {
+		fmt.Fprintln(stderr, "Error: Invalid ping arguments.")
+		return nil, errUsage
+	}
+	start := time.Now()
+	stats, err := c.Ping(*count, *interval)
+	r := newReport("ping", server, time.Since(start), err)
+	r.setPingStats(stats)
+	return r, err
+}
+
+// runCheck runs the check command, whose only argument is the server address
+// which overrides -s.
+func runCheck(c *stun.Client, server string, args []string, stderr io.Writer) (*report, error) {
+	if len(args) > 1 {
+		fmt.Fprintln(stderr, "Error: Invalid check arguments.")
+		return nil, errUsage
+	}
+	if len(args) == 1 {
+		server = args[0]
+		c.SetServerAddr(server)
+	}
+	start := time.Now()
+	result, err := c.CheckServer()
+	r := newReport("check", server, time.Since(start), err)
+	r.setServerReport(result)
+	if err == stun.ErrBlocked {
+		r.blocked = true
+	}
+	return r, err
+}
+
+// printText prints the report in the human readable format.
+func printText(stdout, stderr io.Writer, r *report, err error) {
+	if c := r.Check; c != nil {
+		fmt.Fprintln(stdout, "CHECK", r.Server)
+		for _, check := range c.Checks {
+			result := "FAIL"
+			if check.Passed {
+				result = "PASS"
+			}
+			fmt.Fprintf(stdout, "%s  %-28s %s\n", result, check.Name, check.Detail)
+		}
+		if err == nil {
+			fmt.Fprintln(stdout, "RFC 3489 discovery:", supported(c.RFC3489))
+			fmt.Fprintln(stdout, "RFC 5780 behavior tests:", supported(c.RFC5780))
+		}
+	}
 	if err != nil {
-		return err
+		fmt.Fprintln(stderr, "Error:", err)
+		return
 	}
+	if r.Check != nil {
+		return
+	}
+	if p := r.Ping; p != nil {
+		fmt.Fprintln(stdout, "PING", r.Server)
+		for i, rtt := range p.RTTsMS {
+			if rtt == nil {
+				fmt.Fprintf(stdout, "seq=%d lost\n", i+1)
+			} else {
+				fmt.Fprintf(stdout, "seq=%d rtt=%.3f ms\n", i+1, *rtt)
+			}
+		}
+		fmt.Fprintf(stdout, "--- %d requests sent, %d responses received, %.1f%% loss\n",
+			p.Sent, p.Received, p.Loss*100)
+		if p.Received > 0 {
+			fmt.Fprintf(stdout, "rtt min/avg/max/jitter = %.3f/%.3f/%.3f/%.3f ms\n",
+				p.MinMS, p.AvgMS, p.MaxMS, p.JitterMS)
+		}
+		return
+	}
+	if r.Behavior != nil {
+		fmt.Fprintln(stdout, "  Mapping Behavior:", r.Behavior.Mapping)
+		fmt.Fprintln(stdout, "Filtering Behavior:", r.Behavior.Filtering)
+		fmt.Fprintln(stdout, "   Normal NAT Type:", r.Behavior.NormalType)
+		return
+	}
+	if r.NATType != nil {
+		fmt.Fprintln(stdout, "NAT Type:", *r.NATType)
+	}
+	if r.MappedAddress != nil {
+		fmt.Fprintln(stdout, "External IP Family:", r.MappedAddress.FamilyCode)
+		fmt.Fprintln(stdout, "External IP:", r.MappedAddress.IP)
+		fmt.Fprintln(stdout, "External Port:", r.MappedAddress.Port)
+	}
+}
 
-	if natBehavior != nil {
-		fmt.Println("  Mapping Behavior:", natBehavior.MappingType)
-		fmt.Println("Filtering Behavior:", natBehavior.FilteringType)
-		fmt.Println("   Normal NAT Type:", natBehavior.NormalType())
+func supported(v bool) string {
+	if v {
+		return "supported"
 	}
-	return nil
+	return "not supported"
 }
@@ -0,0 +1,386 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+func host(t *testing.T, s string) *stun.Host {
+	h := new(stun.Host)
+	if err := h.UnmarshalText([]byte(s)); err != nil {
+		t.Fatalf("UnmarshalText error: %v", err)
+	}
+	return h
+}
+
+// testReports returns reports of every mode, with all kinds of values.
+func testReports(t *testing.T) map[string]*report {
+	discover := newReport("discover", "1.0.0.1:3478", 1500*time.Microsecond, nil)
+	discover.setDiscoveryResult(&stun.DiscoveryResult{
+		NAT:    stun.NATFull,
+		Host:   host(t, "2.0.0.1:5000"),
+		Reason: "Mapped address is not local, and response to Test II",
+		Tests: []stun.TestResult{
+			{Name: "Test I", Dest: host(t, "1.0.0.1:3478"), Attempts: 1, RTT: time.Millisecond, Responded: true,
+				ServerAddr: host(t, "1.0.0.1:3478"), MappedAddr: host(t, "2.0.0.1:5000"), ChangedAddr: host(t, "1.0.0.2:3479")},
+			{Name: "Test II", Dest: host(t, "1.0.0.1:3478"), ChangeIP: true, ChangePort: true, Attempts: 9},
+		},
+	})
+	ping := newReport("ping", "1.0.0.1:3478", 2*time.Second, nil)
+	ping.setPingStats(&stun.PingStats{Sent: 2, Received: 1, Loss: 0.5, Min: time.Millisecond,
+		Avg: time.Millisecond, Max: time.Millisecond, RTTs: []time.Duration{time.Millisecond, 0}})
+	check := newReport("check", "1.0.0.1:3478", time.Second, nil)
+	check.setServerReport(&stun.ServerReport{RFC3489: true, Checks: []stun.ServerCheck{
+		{Name: "binding", Passed: true, Detail: "mapped \"2.0.0.1:5000\""},
+		{Name: "other address", Detail: "none"},
+	}})
+	blocked := newReport("behavior", "1.0.0.1:3478", 9500*time.Millisecond, stun.ErrBlocked)
+	blocked.blocked = true
+	return map[string]*report{"discover": discover, "ping": ping, "check": check, "blocked": blocked}
+}
+
+// The reports in JSON, which pin the schema: every field is always present,
+// and missing values are null.
+var wantJSON = map[string]string{
+	"discover": `{
+  "mode": "discover",
+  "server": "1.0.0.1:3478",
+  "nat_type": "Full cone NAT",
+  "nat_type_code": 4,
+  "reason": "Mapped address is not local, and response to Test II",
+  "mapped_address": {
+    "ip": "2.0.0.1",
+    "port": 5000,
+    "family": "IPv4",
+    "family_code": 1
+  },
+  "behavior": null,
+  "tests": [
+    {
+      "name": "Test I",
+      "destination": "1.0.0.1:3478",
+      "change_ip": false,
+      "change_port": false,
+      "attempts": 1,
+      "responded": true,
+      "rtt_ms": 1,
+      "server_address": "1.0.0.1:3478",
+      "mapped_address": {
+        "ip": "2.0.0.1",
+        "port": 5000,
+        "family": "IPv4",
+        "family_code": 1
+      },
+      "other_address": "1.0.0.2:3479"
+    },
+    {
+      "name": "Test II",
+      "destination": "1.0.0.1:3478",
+      "change_ip": true,
+      "change_port": true,
+      "attempts": 9,
+      "responded": false,
+      "rtt_ms": null,
+      "server_address": null,
+      "mapped_address": null,
+      "other_address": null
+    }
+  ],
+  "ping": null,
+  "check": null,
+  "duration_ms": 1.5,
+  "error": null
+}
+`,
+	"blocked": `{
+  "mode": "behavior",
+  "server": "1.0.0.1:3478",
+  "nat_type": null,
+  "nat_type_code": null,
+  "reason": null,
+  "mapped_address": null,
+  "behavior": null,
+  "tests": [],
+  "ping": null,
+  "check": null,
+  "duration_ms": 9500,
+  "error": "NAT blocked"
+}
+`,
+}
+
+// The reports in YAML, with the same keys and values as in JSON.
+var wantYAML = map[string]string{
+	"discover": `mode: "discover"
+server: "1.0.0.1:3478"
+nat_type: "Full cone NAT"
+nat_type_code: 4
+reason: "Mapped address is not local, and response to Test II"
+mapped_address:
+  ip: "2.0.0.1"
+  port: 5000
+  family: "IPv4"
+  family_code: 1
+behavior: null
+tests:
+  - name: "Test I"
+    destination: "1.0.0.1:3478"
+    change_ip: false
+    change_port: false
+    attempts: 1
+    responded: true
+    rtt_ms: 1
+    server_address: "1.0.0.1:3478"
+    mapped_address:
+      ip: "2.0.0.1"
+      port: 5000
+      family: "IPv4"
+      family_code: 1
+    other_address: "1.0.0.2:3479"
+  - name: "Test II"
+    destination: "1.0.0.1:3478"
+    change_ip: true
+    change_port: true
+    attempts: 9
+    responded: false
+    rtt_ms: null
+    server_address: null
+    mapped_address: null
+    other_address: null
+ping: null
+check: null
+duration_ms: 1.5
+error: null
+`,
+	"ping": `mode: "ping"
+server: "1.0.0.1:3478"
+nat_type: null
+nat_type_code: null
+reason: null
+mapped_address: null
+behavior: null
+tests: []
+ping:
+  sent: 2
+  received: 1
+  loss: 0.5
+  min_ms: 1
+  avg_ms: 1
+  max_ms: 1
+  jitter_ms: 0
+  rtts_ms:
+    - 1
+    - null
+check: null
+duration_ms: 2000
+error: null
+`,
+	"check": `mode: "check"
+server: "1.0.0.1:3478"
+nat_type: null
+nat_type_code: null
+reason: null
+mapped_address: null
+behavior: null
+tests: []
+ping: null
+check:
+  rfc3489: true
+  rfc5780: false
+  checks:
+    - name: "binding"
+      passed: true
+      detail: "mapped \"2.0.0.1:5000\""
+    - name: "other address"
+      passed: false
+      detail: "none"
+duration_ms: 1000
+error: null
+`,
+}
+
+func TestWriteReport(t *testing.T) {
+	reports := testReports(t)
+	for name, want := range wantJSON {
+		var b bytes.Buffer
+		if err := writeReport(&b, "json", reports[name]); err != nil {
+			t.Fatalf("%s: writeReport error: %v", name, err)
+		}
+		if b.String() != want {
+			t.Errorf("%s: JSON\n%s\nwant\n%s", name, b.String(), want)
+		}
+	}
+	for name, want := range wantYAML {
+		var b bytes.Buffer
+		if err := writeReport(&b, "yaml", reports[name]); err != nil {
+			t.Fatalf("%s: writeReport error: %v", name, err)
+		}
+		if b.String() != want {
+			t.Errorf("%s: YAML\n%s\nwant\n%s", name, b.String(), want)
+		}
+	}
+}
+
+// yamlKeys returns the keys at the top level of the YAML document s.
+func yamlKeys(s string) []string {
+	var keys []string
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.Index(line, ":"); i > 0 && line[0] != ' ' {
+			keys = append(keys, line[:i])
+		}
+	}
+	return keys
+}
+
+func TestReportFormats(t *testing.T) {
+	for name, r := range testReports(t) {
+		var j, y bytes.Buffer
+		if err := writeReport(&j, "json", r); err != nil {
+			t.Fatalf("%s: writeReport error: %v", name, err)
+		}
+		if err := writeReport(&y, "yaml", r); err != nil {
+			t.Fatalf("%s: writeReport error: %v", name, err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(j.Bytes(), &m); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", name, err)
+		}
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		yaml := yamlKeys(y.String())
+		sort.Strings(yaml)
+		if !reflect.DeepEqual(keys, yaml) || len(keys) != reflect.TypeOf(report{}).NumField()-2 {
+			t.Errorf("%s: JSON keys %v, YAML keys %v", name, keys, yaml)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	reports := testReports(t)
+	failed := newReport("check", "1.0.0.1:3478", time.Second, nil)
+	failed.setServerReport(&stun.ServerReport{Checks: []stun.ServerCheck{{Name: "binding"}}})
+	for _, test := range []struct {
+		name string
+		r    *report
+		code int
+	}{
+		{"discover", reports["discover"], exitOK},
+		{"ping", reports["ping"], exitOK},
+		{"check", reports["check"], exitError},
+		{"passed check", newReport("check", "1.0.0.1:3478", time.Second, nil), exitOK},
+		{"failed check", failed, exitError},
+		{"error", newReport("discover", "1.0.0.1:3478", time.Second, errors.New("Server error: no mapped address")), exitError},
+		{"blocked", reports["blocked"], exitBlocked},
+	} {
+		if code := test.r.exitCode(); code != test.code {
+			t.Errorf("%s: exit code %d, want %d", test.name, code, test.code)
+		}
+	}
+}
+
+// listenServer starts a STUN server on 127.0.0.1 and 127.0.0.2, and returns
+// its primary address.
+func listenServer(t *testing.T) string {
+	var conns [2][2]net.PacketConn
+	for i, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		for j := range conns[i] {
+			conn, err := net.ListenPacket("udp4", ip+":0")
+			if err != nil {
+				t.Skipf("ListenPacket error: %v", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			conns[i][j] = conn
+		}
+	}
+	s := stun.NewServer(conns)
+	go s.Serve()
+	return conns[0][0].LocalAddr().String()
+}
+
+func TestRun(t *testing.T) {
+	server := listenServer(t)
+	// A socket which never answers, as behind a firewall blocking UDP.
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer silent.Close()
+	for _, test := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"discover", []string{"-s", server, "-i", "127.0.0.1", "-format", "json"}, exitOK},
+		{"discover yaml", []string{"-s", server, "-i", "127.0.0.1", "-format", "yaml"}, exitOK},
+		{"ping", []string{"-s", server, "-i", "127.0.0.1", "-format", "json", "ping", "-c", "1"}, exitOK},
+		{"blocked", []string{"-s", silent.LocalAddr().String(), "-i", "127.0.0.1", "-format", "json", "ping", "-c", "1"}, exitBlocked},
+		{"error", []string{"-s", "127.0.0.1:notaport", "-format", "json"}, exitError},
+		{"help", []string{"-h"}, exitOK},
+		{"unknown flag", []string{"-x"}, exitUsage},
+		{"unknown format", []string{"-format", "xml"}, exitUsage},
+		{"unknown command", []string{"traceroute"}, exitUsage},
+		{"ping count", []string{"-s", server, "ping", "-c", "0"}, exitUsage},
+		{"check arguments", []string{"-s", server, "check", "a", "b"}, exitUsage},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run(test.args, &stdout, &stderr); code != test.code {
+			t.Errorf("%s: exit code %d, want %d, stderr %q", test.name, code, test.code, stderr.String())
+		}
+		if test.code == exitUsage && stdout.Len() != 0 {
+			t.Errorf("%s: output %q", test.name, stdout.String())
+		}
+		if test.code != exitUsage && strings.Contains(strings.Join(test.args, " "), "-format json") &&
+			!json.Valid(stdout.Bytes()) {
+			t.Errorf("%s: invalid JSON %q", test.name, stdout.String())
+		}
+	}
+
+	// The exit code of check tells whether every check passed.
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-s", server, "-i", "127.0.0.1", "-format", "json", "check"}, &stdout, &stderr)
+	var r struct {
+		Check struct {
+			Checks []struct {
+				Passed bool `json:"passed"`
+			} `json:"checks"`
+		} `json:"check"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &r); err != nil || len(r.Check.Checks) == 0 {
+		t.Fatalf("check: invalid output %q: %v", stdout.String(), err)
+	}
+	want := exitOK
+	for _, c := range r.Check.Checks {
+		if !c.Passed {
+			want = exitError
+		}
+	}
+	if code != want {
+		t.Errorf("check: exit code %d, want %d", code, want)
+	}
+}
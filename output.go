@@ -0,0 +1,294 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// report is the machine readable output. Fields are never omitted, so that
+// scripts can rely on the schema; those which do not apply are null.
+type report struct {
+	Mode          string          `json:"mode"` // "discover", "behavior", "ping" or "check"
+	Server        string          `json:"server"`
+	NATType       *string         `json:"nat_type"`
+	NATTypeCode   *int            `json:"nat_type_code"`
+	Reason        *string         `json:"reason"`
+	MappedAddress *addressReport  `json:"mapped_address"`
+	Behavior      *behaviorReport `json:"behavior"`
+	Tests         []testReport    `json:"tests"`
+	Ping          *pingReport     `json:"ping"`
+	Check         *checkReport    `json:"check"`
+	DurationMS    float64         `json:"duration_ms"`
+	Error         *string         `json:"error"`
+
+	blocked bool
+	failed  bool // some check of the server failed
+}
+
+type addressReport struct {
+	IP         string `json:"ip"`
+	Port       uint16 `json:"port"`
+	Family     string `json:"family"`
+	FamilyCode uint16 `json:"family_code"`
+}
+
+type behaviorReport struct {
+	Mapping    string `json:"mapping"`
+	Filtering  string `json:"filtering"`
+	NormalType string `json:"normal_type"`
+}
+
+type testReport struct {
+	Name          string         `json:"name"`
+	Destination   string         `json:"destination"`
+	ChangeIP      bool           `json:"change_ip"`
+	ChangePort    bool           `json:"change_port"`
+	Attempts      int            `json:"attempts"`
+	Responded     bool           `json:"responded"`
+	RTTMS         *float64       `json:"rtt_ms"`
+	ServerAddress *string        `json:"server_address"`
+	MappedAddress *addressReport `json:"mapped_address"`
+	OtherAddress  *string        `json:"other_address"`
+}
+
+type pingReport struct {
+	Sent     int        `json:"sent"`
+	Received int        `json:"received"`
+	Loss     float64    `json:"loss"`
+	MinMS    float64    `json:"min_ms"`
+	AvgMS    float64    `json:"avg_ms"`
+	MaxMS    float64    `json:"max_ms"`
+	JitterMS float64    `json:"jitter_ms"`
+	RTTsMS   []*float64 `json:"rtts_ms"` // null for the lost requests
+}
+
+type checkReport struct {
+	RFC3489 bool          `json:"rfc3489"`
+	RFC5780 bool          `json:"rfc5780"`
+	Checks  []checkResult `json:"checks"`
+}
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+func newReport(mode, server string, d time.Duration, err error) *report {
+	r := &report{Mode: mode, Server: server, Tests: []testReport{}}
+	r.DurationMS = milliseconds(d)
+	if err != nil {
+		s := err.Error()
+		r.Error = &s
+	}
+	return r
+}
+
+func (r *report) setDiscoveryResult(result *stun.DiscoveryResult) {
+	nat := result.NAT.String()
+	code := int(result.NAT)
+	r.NATType = &nat
+	r.NATTypeCode = &code
+	if result.Reason != "" {
+		r.Reason = &result.Reason
+	}
+	r.MappedAddress = newAddressReport(result.Host)
+	r.blocked = result.NAT == stun.NATBlocked
+	for _, t := range result.Tests {
+		tr := testReport{
+			Name:        t.Name,
+			Destination: t.Dest.String(),
+			ChangeIP:    t.ChangeIP,
+			ChangePort:  t.ChangePort,
+			Attempts:    t.Attempts,
+			Responded:   t.Responded,
+		}
+		if t.Responded {
+			rtt := milliseconds(t.RTT)
+			tr.RTTMS = &rtt
+			tr.ServerAddress = hostString(t.ServerAddr)
+			tr.MappedAddress = newAddressReport(t.MappedAddr)
+			tr.OtherAddress = hostString(t.OtherAddr)
+			if tr.OtherAddress == nil {
+				tr.OtherAddress = hostString(t.ChangedAddr)
+			}
+		}
+		r.Tests = append(r.Tests, tr)
+	}
+}
+
+func (r *report) setBehavior(b *stun.NATBehavior) {
+	if b == nil {
+		return
+	}
+	r.Behavior = &behaviorReport{
+		Mapping:    b.MappingType.String(),
+		Filtering:  b.FilteringType.String(),
+		NormalType: b.NormalType(),
+	}
+}
+
+func (r *report) setPingStats(s *stun.PingStats) {
+	if s == nil {
+		return
+	}
+	r.Ping = &pingReport{
+		Sent:     s.Sent,
+		Received: s.Received,
+		Loss:     s.Loss,
+		MinMS:    milliseconds(s.Min),
+		AvgMS:    milliseconds(s.Avg),
+		MaxMS:    milliseconds(s.Max),
+		JitterMS: milliseconds(s.Jitter),
+		RTTsMS:   []*float64{},
+	}
+	for _, rtt := range s.RTTs {
+		var v *float64
+		if rtt > 0 {
+			ms := milliseconds(rtt)
+			v = &ms
+		}
+		r.Ping.RTTsMS = append(r.Ping.RTTsMS, v)
+	}
+	r.blocked = s.Received == 0
+}
+
+func (r *report) setServerReport(s *stun.ServerReport) {
+	if s == nil {
+		return
+	}
+	r.Check = &checkReport{RFC3489: s.RFC3489, RFC5780: s.RFC5780, Checks: []checkResult{}}
+	for _, c := range s.Checks {
+		r.Check.Checks = append(r.Check.Checks, checkResult{c.Name, c.Passed, c.Detail})
+		r.failed = r.failed || !c.Passed
+	}
+}
+
+// exitCode tells a blocked UDP apart from other errors.
+func (r *report) exitCode() int {
+	switch {
+	case r.blocked:
+		return exitBlocked
+	case r.Error != nil, r.failed:
+		return exitError
+	}
+	return exitOK
+}
+
+func newAddressReport(h *stun.Host) *addressReport {
+	if h == nil {
+		return nil
+	}
+	a := &addressReport{IP: h.IP(), Port: h.Port(), FamilyCode: h.Family()}
+	switch h.Family() {
+	case 1:
+		a.Family = "IPv4"
+	case 2:
+		a.Family = "IPv6"
+	default:
+		a.Family = "Unknown"
+	}
+	return a
+}
+
+func hostString(h *stun.Host) *string {
+	if h == nil {
+		return nil
+	}
+	s := h.String()
+	return &s
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// writeReport writes the report in JSON or YAML.
+func writeReport(w io.Writer, format string, r *report) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	var b bytes.Buffer
+	writeYAML(&b, reflect.ValueOf(*r), "")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// writeYAML writes the exported fields of a struct as YAML, using the names
+// of the JSON tags. Strings are double quoted, which is valid in both YAML
+// and JSON, so no escaping rules of YAML are needed.
+func writeYAML(b *bytes.Buffer, v reflect.Value, indent string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		b.WriteString(indent + name + ":")
+		writeYAMLValue(b, v.Field(i), indent)
+	}
+}
+
+func writeYAMLValue(b *bytes.Buffer, v reflect.Value, indent string) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			b.WriteString(" null\n")
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		b.WriteString("\n")
+		writeYAML(b, v, indent+"  ")
+	case reflect.Slice:
+		if v.Len() == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+		b.WriteString("\n")
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			if elem.Kind() != reflect.Struct {
+				b.WriteString(indent + "  -")
+				writeYAMLValue(b, elem, indent+"  ")
+				continue
+			}
+			// Write the struct indented, then turn the indent of its
+			// first line into the list marker.
+			var fields bytes.Buffer
+			writeYAML(&fields, elem, indent+"    ")
+			b.WriteString(indent + "  - " + strings.TrimPrefix(fields.String(), indent+"    "))
+		}
+	case reflect.String:
+		b.WriteString(" " + strconv.Quote(v.String()) + "\n")
+	case reflect.Float32, reflect.Float64:
+		b.WriteString(" " + strconv.FormatFloat(v.Float(), 'f', -1, 64) + "\n")
+	default:
+		fmt.Fprintf(b, " %v\n", v.Interface())
+	}
+}
@@ -15,30 +15,152 @@
 package stun
 
 import (
+	"crypto/sha1"
 	"encoding/binary"
-	"hash/crc32"
+	"fmt"
+	"hash"
 	"net"
+	"sync"
 )
 
 type attribute struct {
 	types  uint16
-	length uint16
-	value  []byte
+	length uint16 // of the value without padding, as on the wire
+	value  []byte // padded if built locally, not if decoded
 }
 
+// newAttribute returns an attribute of value, whose length excludes the
+// padding as RFC 5389 section 15 requires. The value is padded in a copy, so
+// that the array of the caller is never written.
 func newAttribute(types uint16, value []byte) *attribute {
 	att := new(attribute)
 	att.types = types
-	att.value = padding(value)
-	att.length = uint16(len(att.value))
+	att.length = uint16(len(value))
+	att.value = padding(value[:len(value):len(value)])
 	return att
 }
 
-func newFingerprintAttribute(packet *packet) *attribute {
-	crc := crc32.ChecksumIEEE(packet.bytes()) ^ fingerprint
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, crc)
-	return newAttribute(attributeFingerprint, buf)
+// hmacState is the state of HMAC-SHA1 of RFC 2104, which is pooled, since
+// every message is keyed differently and hmac.New would allocate each time.
+type hmacState struct {
+	h      hash.Hash
+	key    [sha1.Size]byte // digest of a key longer than a block
+	pad    [sha1.BlockSize]byte
+	header [4]byte
+	sum    [sha1.Size]byte
+}
+
+var hmacPool = sync.Pool{
+	New: func() interface{} {
+		return &hmacState{h: sha1.New()}
+	},
+}
+
+// zeroBlock pads a message of RFC 3489 to a multiple of 64 bytes.
+var zeroBlock [64]byte
+
+// messageIntegrity appends to dst the HMAC-SHA1 of b, which holds the packet
+// up to the MESSAGE-INTEGRITY attribute. The length in the header is set as
+// if the packet ended right after MESSAGE-INTEGRITY, following RFC 5389. A
+// packet of RFC 3489 is padded with zeros to a multiple of 64 bytes before.
+func messageIntegrity(dst, b, key []byte) []byte {
+	s := hmacPool.Get().(*hmacState)
+	dst = append(dst, s.compute(b, key)...)
+	hmacPool.Put(s)
+	return dst
+}
+
+// compute returns the HMAC of b like messageIntegrity, which is valid until
+// s is used again.
+func (s *hmacState) compute(b, key []byte) []byte {
+	h := s.h
+	if len(key) > sha1.BlockSize {
+		h.Reset()
+		h.Write(key)
+		key = h.Sum(s.key[:0])
+	}
+	for i := range s.pad {
+		s.pad[i] = 0x36
+	}
+	for i, k := range key {
+		s.pad[i] ^= k
+	}
+	h.Reset()
+	h.Write(s.pad[:])
+	copy(s.header[:], b[:4])
+	binary.BigEndian.PutUint16(s.header[2:4], uint16(len(b)-20+24))
+	h.Write(s.header[:])
+	h.Write(b[4:])
+	if binary.BigEndian.Uint32(b[4:8]) != magicCookie {
+		h.Write(zeroBlock[:(64-len(b)%64)%64])
+	}
+	inner := h.Sum(s.sum[:0])
+	for i := range s.pad {
+		s.pad[i] = 0x5c
+	}
+	for i, k := range key {
+		s.pad[i] ^= k
+	}
+	h.Reset()
+	h.Write(s.pad[:])
+	h.Write(inner)
+	return h.Sum(s.sum[:0])
+}
+
+func newUsernameAttribute(name string) *attribute {
+	return newAttribute(attributeUsername, []byte(name))
+}
+
+func newUseCandidateAttribute() *attribute {
+	return newAttribute(attributeUseCandidate, nil)
+}
+
+func newPriorityAttribute(priority uint32) *attribute {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, priority)
+	return newAttribute(attributePriority, value)
+}
+
+func newIceControllingAttribute(tieBreaker uint64) *attribute {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, tieBreaker)
+	return newAttribute(attributeIceControlling, value)
+}
+
+func newXorAddrAttribute(types uint16, addr *net.UDPAddr, transID []byte) *attribute {
+	return newAttribute(types, appendXorAddr(nil, addr, transID))
+}
+
+// appendXorAddr appends the value of an XOR address attribute to b.
+func appendXorAddr(b []byte, addr *net.UDPAddr, transID []byte) []byte {
+	ip := addr.IP.To4()
+	family := byte(attributeFamilyIPv4)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = attributeFamilyIPV6
+	}
+	port := uint16(addr.Port) ^ binary.BigEndian.Uint16(transID[:2])
+	b = append(b, 0, family, byte(port>>8), byte(port))
+	for i := range ip {
+		b = append(b, ip[i]^transID[i])
+	}
+	return b
+}
+
+func newRawAddrAttribute(types uint16, addr *net.UDPAddr) *attribute {
+	return newAttribute(types, appendRawAddr(nil, addr))
+}
+
+// appendRawAddr appends the value of an address attribute to b.
+func appendRawAddr(b []byte, addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	family := byte(attributeFamilyIPv4)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = attributeFamilyIPV6
+	}
+	b = append(b, 0, family, byte(addr.Port>>8), byte(addr.Port))
+	return append(b, ip...)
 }
 
 func newSoftwareAttribute(name string) *attribute {
@@ -66,16 +188,15 @@ func newChangeReqAttribute(changeIP bool, changePort bool) *attribute {
 //
 //             Figure 6: Format of XOR-MAPPED-ADDRESS Attribute
 func (v *attribute) xorAddr(transID []byte) *Host {
-	xorIP := make([]byte, 16)
-	for i := 0; i < len(v.value)-4; i++ {
+	if validateAddr(v.value) != nil || len(transID) != 16 {
+		return nil
+	}
+	xorIP := make([]byte, len(v.value)-4)
+	for i := range xorIP {
 		xorIP[i] = v.value[i+4] ^ transID[i]
 	}
 	family := uint16(v.value[1])
 	port := binary.BigEndian.Uint16(v.value[2:4])
-	// Truncate if IPv4, otherwise net.IP sometimes renders it as an IPv6 address.
-	if family == attributeFamilyIPv4 {
-		xorIP = xorIP[:4]
-	}
 	x := binary.BigEndian.Uint16(transID[:2])
 	return &Host{family, net.IP(xorIP).String(), port ^ x}
 }
@@ -92,13 +213,100 @@ func (v *attribute) xorAddr(transID []byte) *Host {
 //
 //               Figure 5: Format of MAPPED-ADDRESS Attribute
 func (v *attribute) rawAddr() *Host {
+	if validateAddr(v.value) != nil {
+		return nil
+	}
 	host := new(Host)
 	host.family = uint16(v.value[1])
 	host.port = binary.BigEndian.Uint16(v.value[2:4])
-	// Truncate if IPv4, otherwise net.IP sometimes renders it as an IPv6 address.
-	if host.family == attributeFamilyIPv4 {
-		v.value = v.value[:8]
-	}
 	host.ip = net.IP(v.value[4:]).String()
 	return host
 }
+
+// validateAddr checks the value of an address attribute, whose length must
+// match its family.
+func validateAddr(value []byte) error {
+	if len(value) < 4 {
+		return fmt.Errorf("length %d too short for an address", len(value))
+	}
+	switch value[1] {
+	case attributeFamilyIPv4:
+		if len(value) != 4+net.IPv4len {
+			return fmt.Errorf("length %d of an IPv4 address", len(value))
+		}
+	case attributeFamilyIPV6:
+		if len(value) != 4+net.IPv6len {
+			return fmt.Errorf("length %d of an IPv6 address", len(value))
+		}
+	default:
+		return fmt.Errorf("unknown address family %d", value[1])
+	}
+	return nil
+}
+
+// addrAttributes are the attributes whose value is an address.
+var addrAttributes = map[uint16]bool{
+	attributeMappedAddress:       true,
+	attributeResponseAddress:     true,
+	attributeSourceAddress:       true,
+	attributeChangedAddress:      true,
+	attributeReflectedFrom:       true,
+	attributeXorPeerAddress:      true,
+	attributeXorRelayedAddress:   true,
+	attributeXorMappedAddress:    true,
+	attributeXorMappedAddressExp: true,
+	attributeAlternateServer:     true,
+	attributeResponseOrigin:      true,
+	attributeOtherAddress:        true,
+}
+
+// attributeLengths are the lengths of the attributes of a fixed length.
+var attributeLengths = map[uint16]int{
+	attributeChangeRequest:    4,
+	attributeMessageIntegrity: 20,
+	attributeLifetime:         4,
+	attributePriority:         4,
+	attributeUseCandidate:     0,
+	attributeResponsePort:     4,
+	attributeFingerprint:      4,
+	attributeIceControlled:    8,
+	attributeIceControlling:   8,
+}
+
+// attributeMaxLengths are the maximum lengths of the variable attributes.
+var attributeMaxLengths = map[uint16]int{
+	attributeUsername: 512,
+	attributeRealm:    763,
+	attributeNonce:    763,
+	attributeSoftware: 763,
+}
+
+// validate checks the length and content of a received attribute, as
+// required by the RFCs. Unknown attributes are not checked.
+func (v *attribute) validate() error {
+	var err error
+	switch {
+	case addrAttributes[v.types]:
+		err = validateAddr(v.value)
+	case v.types == attributeErrorCode:
+		if len(v.value) < 4 {
+			err = fmt.Errorf("length %d too short", len(v.value))
+		} else if class, number := v.value[2]&0x07, v.value[3]; class < 3 || class > 6 || number > 99 {
+			err = fmt.Errorf("invalid code %d%02d", class, number)
+		}
+	case v.types == attributeUnknownAttributes:
+		if len(v.value)%2 != 0 {
+			err = fmt.Errorf("odd length %d", len(v.value))
+		}
+	default:
+		if n, ok := attributeLengths[v.types]; ok && len(v.value) != n {
+			err = fmt.Errorf("length %d, expected %d", len(v.value), n)
+		} else if n, ok := attributeMaxLengths[v.types]; ok && len(v.value) > n {
+			err = fmt.Errorf("length %d longer than %d", len(v.value), n)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Received data format mismatch: attribute 0x%04x: %v", v.types, err)
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CacheEntry is a cached result of Discover or BehaviorTest.
+type CacheEntry struct {
+	NAT        NATType
+	Host       *Host
+	Reason     string
+	Behavior   *NATBehavior
+	Interfaces string // local interface addresses when the result was cached
+	Expires    time.Time
+}
+
+// CacheStore stores the entries of a cache. It must be safe for concurrent
+// use.
+type CacheStore interface {
+	// Get returns the entry of key, or nil if there is none.
+	Get(key string) (*CacheEntry, error)
+	Set(key string, e *CacheEntry) error
+	Delete(key string) error
+}
+
+// Cache keeps the results of discovery for a while, so that the clients
+// sharing it do not repeat the tests. Results are cached by the local
+// address and the server address. A cached result is dropped when it
+// expires, when the local interface addresses change, and when Keepalive
+// gets a mapped address other than the cached one.
+type Cache struct {
+	store CacheStore
+	ttl   time.Duration
+}
+
+// NewCache returns a cache whose entries live for ttl in store.
+func NewCache(store CacheStore, ttl time.Duration) *Cache {
+	return &Cache{store: store, ttl: ttl}
+}
+
+// SetCache sets the cache of the results of Discover and BehaviorTest, which
+// may be shared by many clients. Results from a cache have no tests.
+func (c *Client) SetCache(cache *Cache) {
+	c.cache = cache
+}
+
+// Invalidate drops every result of the local address and server address.
+func (cache *Cache) Invalidate(local, server string) error {
+	for _, kind := range []string{"discover", "behavior"} {
+		if err := cache.store.Delete(cacheKey(kind, local, server)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cacheKey(kind, local, server string) string {
+	return kind + " " + local + " " + server
+}
+
+// get returns the entry of key, unless it is out of date.
+func (cache *Cache) get(key, interfaces string) *CacheEntry {
+	e, err := cache.store.Get(key)
+	if err != nil || e == nil {
+		return nil
+	}
+	if time.Now().After(e.Expires) || e.Interfaces != interfaces {
+		cache.store.Delete(key)
+		return nil
+	}
+	return e
+}
+
+func (cache *Cache) set(key, interfaces string, e *CacheEntry) error {
+	e.Interfaces = interfaces
+	e.Expires = time.Now().Add(cache.ttl)
+	return cache.store.Set(key, e)
+}
+
+// cacheLocal returns the local address of the results of the client.
+func (c *Client) cacheLocal() string {
+	if c.conn != nil {
+		return c.conn.LocalAddr().String()
+	}
+	return c.iface + " " + net.JoinHostPort(c.localIP, strconv.Itoa(c.localPort))
+}
+
+// cacheInterfaces returns the current interface addresses, which tell
+// whether a cached result is still valid.
+func (c *Client) cacheInterfaces() string {
+	addrs, err := c.interfaces.Addrs()
+	if err != nil {
+		return ""
+	}
+	sortInterfaceAddrs(addrs)
+	return joinInterfaceAddrs(addrs)
+}
+
+// cachedDiscover returns the cached result of Discover, or nil.
+func (c *Client) cachedDiscover(server string) *DiscoveryResult {
+	if c.cache == nil {
+		return nil
+	}
+	e := c.cache.get(cacheKey("discover", c.cacheLocal(), server), c.cacheInterfaces())
+	if e == nil {
+		return nil
+	}
+	c.logger.Log(LevelDebug, "cached result", "nat", e.NAT, "mapped", e.Host)
+	return &DiscoveryResult{NAT: e.NAT, Host: e.Host, Reason: e.Reason}
+}
+
+func (c *Client) cacheDiscover(server string, result *DiscoveryResult) {
+	if c.cache == nil {
+		return
+	}
+	e := &CacheEntry{NAT: result.NAT, Host: result.Host, Reason: result.Reason}
+	err := c.cache.set(cacheKey("discover", c.cacheLocal(), server), c.cacheInterfaces(), e)
+	if err != nil {
+		c.logger.Log(LevelWarn, "cache failed", "err", err)
+	}
+}
+
+// cachedBehavior returns the cached result of BehaviorTest, or nil.
+func (c *Client) cachedBehavior(server string) *NATBehavior {
+	if c.cache == nil {
+		return nil
+	}
+	e := c.cache.get(cacheKey("behavior", c.cacheLocal(), server), c.cacheInterfaces())
+	// A store shared with others may hold an entry without the behavior,
+	// which is a miss.
+	if e == nil || e.Behavior == nil {
+		return nil
+	}
+	c.logger.Log(LevelDebug, "cached result", "mapping", e.Behavior.MappingType,
+		"filtering", e.Behavior.FilteringType)
+	return e.Behavior
+}
+
+func (c *Client) cacheBehavior(server string, b *NATBehavior) {
+	if c.cache == nil {
+		return
+	}
+	err := c.cache.set(cacheKey("behavior", c.cacheLocal(), server), c.cacheInterfaces(),
+		&CacheEntry{Behavior: b})
+	if err != nil {
+		c.logger.Log(LevelWarn, "cache failed", "err", err)
+	}
+}
+
+// checkCachedMapping drops the cached results if the mapped address differs
+// from the cached one.
+func (c *Client) checkCachedMapping(server string, mapped *Host) {
+	if c.cache == nil {
+		return
+	}
+	local := c.cacheLocal()
+	e, err := c.cache.store.Get(cacheKey("discover", local, server))
+	if err != nil || e == nil || e.Host == nil || e.Host.String() == mapped.String() {
+		return
+	}
+	c.logger.Log(LevelInfo, "cached mapping changed", "cached", e.Host, "mapped", mapped)
+	c.invalidateCache(server)
+}
+
+func (c *Client) invalidateCache(server string) {
+	if c.cache == nil {
+		return
+	}
+	if err := c.cache.Invalidate(c.cacheLocal(), server); err != nil {
+		c.logger.Log(LevelWarn, "cache failed", "err", err)
+	}
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]CacheEntry
+}
+
+// NewMemoryStore returns a cache store in memory.
+func NewMemoryStore() CacheStore {
+	return &memoryStore{entries: make(map[string]CacheEntry)}
+}
+
+func (s *memoryStore) Get(key string) (*CacheEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+func (s *memoryStore) Set(key string, e *CacheEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = *e
+	return nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+type fileStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// The lock file of a file store is given up on after fileLockTimeout, and
+// broken if it is older than fileLockStale, since its process is gone.
+const (
+	fileLockTimeout = 5 * time.Second
+	fileLockStale   = 10 * time.Second
+)
+
+// NewFileStore returns a cache store in a JSON file, which is shared by the
+// processes using the same path. A missing file is an empty store. The
+// changes are serialized by a lock file next to it, whose name ends with
+// ".lock".
+func NewFileStore(path string) CacheStore {
+	return &fileStore{path: path}
+}
+
+// lock creates the lock file, so that no other process reads and writes the
+// store before unlock is called.
+func (s *fileStore) lock() (unlock func(), err error) {
+	name := s.path + ".lock"
+	deadline := time.Now().Add(fileLockTimeout)
+	for {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > fileLockStale {
+			os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("Cache error: " + name + " is locked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fileStore) load() (map[string]*CacheEntry, error) {
+	entries := make(map[string]*CacheEntry)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// save writes the entries to a temporary file first, so that readers never
+// see a partial file.
+func (s *fileStore) save(entries map[string]*CacheEntry) error {
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+func (s *fileStore) Get(key string) (*CacheEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return entries[key], nil
+}
+
+func (s *fileStore) Set(key string, e *CacheEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	entries[key] = e
+	return s.save(entries)
+}
+
+func (s *fileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[key]; !ok {
+		return nil
+	}
+	delete(entries, key)
+	return s.save(entries)
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stun")
+	if err != nil {
+		t.Fatalf("TempDir error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	stores := map[string]CacheStore{
+		"memory": NewMemoryStore(),
+		"file":   NewFileStore(filepath.Join(dir, "cache.json")),
+	}
+	for name, store := range stores {
+		n := nattest.NewNetwork()
+		s := newTestServer(t, n)
+		nat, err := n.NewNAT("2.0.0.1", nattest.Config{PortAllocation: nattest.PortSequential})
+		if err != nil {
+			t.Fatalf("NewNAT error: %v", err)
+		}
+		conn, err := nat.ListenPacket("10.0.0.2", 5000)
+		if err != nil {
+			t.Fatalf("ListenPacket error: %v", err)
+		}
+		defer conn.Close()
+		ifaces := &fakeInterfaces{addrs: []string{"eth0 10.0.0.2/24"}}
+		cache := NewCache(store, time.Hour)
+		newClient := func() *Client {
+			c := newTestClient(conn)
+			c.interfaces = ifaces
+			c.SetCache(cache)
+			return c
+		}
+
+		if _, err := newClient().BehaviorTest(); err != nil {
+			t.Fatalf("%s: BehaviorTest error: %v", name, err)
+		}
+		if _, host, err := newClient().Discover(); err != nil || host.String() != "2.0.0.1:40000" {
+			t.Fatalf("%s: Discover error: %v %v", name, host, err)
+		}
+		// Another client gets the results from the cache, without the server.
+		atomic.StoreInt32(&s.silent, 1)
+		c := newClient()
+		if nt, host, err := c.Discover(); err != nil || nt != NATFull || host.String() != "2.0.0.1:40000" {
+			t.Errorf("%s: cached Discover error: %v %v %v", name, nt, host, err)
+		}
+		if b, err := c.BehaviorTest(); err != nil || b.MappingType != BehaviorTypeEndpoint {
+			t.Errorf("%s: cached BehaviorTest error: %v %v", name, b, err)
+		}
+
+		// The interfaces change, so the server is contacted again.
+		ifaces.set("eth0 10.0.0.2/24", "wlan0 192.168.1.2/24")
+		if nt, _, err := c.Discover(); err != nil || nt != NATBlocked {
+			t.Errorf("%s: Discover error: %v %v after interface change", name, nt, err)
+		}
+		atomic.StoreInt32(&s.silent, 0)
+		if _, _, err := c.Discover(); err != nil {
+			t.Fatalf("%s: Discover error: %v", name, err)
+		}
+
+		// The NAT reboots, and Keepalive sees the new mapping.
+		nat.Flush()
+		if host, err := c.Keepalive(); err != nil || host.String() != "2.0.0.1:40001" {
+			t.Fatalf("%s: Keepalive error: %v %v", name, host, err)
+		}
+		if _, host, err := c.Discover(); err != nil || host.String() != "2.0.0.1:40001" {
+			t.Errorf("%s: Discover error: %v %v after mapping change", name, host, err)
+		}
+	}
+}
+
+func TestCacheNoBehavior(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+	defer conn.Close()
+	store := NewMemoryStore()
+	c := newTestClient(conn)
+	c.interfaces = &fakeInterfaces{}
+	c.SetCache(NewCache(store, time.Hour))
+	// Another client shares the store, and caches an entry without the
+	// behavior.
+	key := cacheKey("behavior", c.cacheLocal(), testServerAddr)
+	store.Set(key, &CacheEntry{NAT: NATFull, Interfaces: c.cacheInterfaces(), Expires: time.Now().Add(time.Hour)})
+	if b, err := c.BehaviorTest(); err != nil || b.MappingType != BehaviorTypeEndpoint {
+		t.Errorf("BehaviorTest error: %v %v", b, err)
+	}
+}
+
+func TestFileStoreProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stun")
+	if err != nil {
+		t.Fatalf("TempDir error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+	// Every store stands for a process, which changes the file at the
+	// same time as the others.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := NewFileStore(path)
+			for j := 0; j < 10; j++ {
+				if err := store.Set(fmt.Sprintf("%d %d", i, j), &CacheEntry{NAT: NATFull}); err != nil {
+					t.Errorf("Set error: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	entries, err := NewFileStore(path).(*fileStore).load()
+	if err != nil || len(entries) != 80 {
+		t.Errorf("%d entries kept, error %v", len(entries), err)
+	}
+
+	// A lock left by a crashed process is broken once stale.
+	lock := path + ".lock"
+	if err := ioutil.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+	old := time.Now().Add(-2 * fileLockStale)
+	os.Chtimes(lock, old, old)
+	if err := NewFileStore(path).Delete("0 0"); err != nil {
+		t.Errorf("Delete error: %v", err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("lock file left: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// EndOfCandidates is the SDP attribute line which tells the remote peer that
+// no more candidates will be trickled (RFC 8840).
+const EndOfCandidates = "a=end-of-candidates"
+
+// CandidateType is the type of an ICE candidate.
+type CandidateType int
+
+// Candidate types, defined in RFC 8445.
+const (
+	CandidateHost CandidateType = iota
+	CandidateServerReflexive
+	CandidatePeerReflexive
+	CandidateRelay
+)
+
+var candidateTypeStr = map[CandidateType]string{
+	CandidateHost:            "host",
+	CandidateServerReflexive: "srflx",
+	CandidatePeerReflexive:   "prflx",
+	CandidateRelay:           "relay",
+}
+
+// Type preferences recommended by RFC 8445, section 5.1.2.2.
+var candidateTypePref = map[CandidateType]uint32{
+	CandidateHost:            126,
+	CandidatePeerReflexive:   110,
+	CandidateServerReflexive: 100,
+	CandidateRelay:           0,
+}
+
+func (t CandidateType) String() string {
+	if s, ok := candidateTypeStr[t]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// Candidate is an ICE candidate: a transport address the peer may be able
+// to reach us at.
+type Candidate struct {
+	Foundation  string
+	Component   int
+	Protocol    string
+	Priority    uint32
+	Addr        *Host
+	Type        CandidateType
+	RelatedAddr *Host // base of a reflexive candidate, nil for host candidates
+}
+
+func newCandidate(t CandidateType, addr, base *Host, server string, component int, localPref uint32) *Candidate {
+	return &Candidate{
+		Foundation:  candidateFoundation(t, base, server),
+		Component:   component,
+		Protocol:    "udp",
+		Priority:    candidatePriority(t, localPref, component),
+		Addr:        addr,
+		Type:        t,
+		RelatedAddr: base,
+	}
+}
+
+// candidatePriority computes the priority as in RFC 8445, section 5.1.2.1.
+func candidatePriority(t CandidateType, localPref uint32, component int) uint32 {
+	return candidateTypePref[t]<<24 | (localPref&0xffff)<<8 | uint32(256-component)&0xff
+}
+
+// candidateFoundation returns the same foundation for candidates of the same
+// type, base IP and STUN server, as required by RFC 8445, section 5.1.1.3.
+func candidateFoundation(t CandidateType, base *Host, server string) string {
+	baseIP := ""
+	if base != nil {
+		baseIP = base.IP()
+	}
+	return strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(t.String()+"/"+baseIP+"/"+server+"/udp"))), 10)
+}
+
+// String returns the candidate in the candidate-attribute format of RFC 8839,
+// without the "a=" prefix.
+func (c *Candidate) String() string {
+	s := fmt.Sprintf("candidate:%s %d %s %d %s %d typ %s",
+		c.Foundation, c.Component, c.Protocol, c.Priority,
+		c.Addr.IP(), c.Addr.Port(), c.Type)
+	if c.RelatedAddr != nil {
+		s += fmt.Sprintf(" raddr %s rport %d", c.RelatedAddr.IP(), c.RelatedAddr.Port())
+	}
+	return s
+}
+
+// SDP returns the candidate as an SDP "a=candidate" line.
+func (c *Candidate) SDP() string {
+	return "a=" + c.String()
+}
+
+// ParseCandidate parses a candidate from the format produced by SDP or
+// String. Unknown extension attributes are ignored.
+func ParseCandidate(s string) (*Candidate, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "a=")
+	if !strings.HasPrefix(s, "candidate:") {
+		return nil, errors.New("Candidate error: missing candidate prefix")
+	}
+	fields := strings.Fields(strings.TrimPrefix(s, "candidate:"))
+	if len(fields) < 8 || fields[6] != "typ" {
+		return nil, errors.New("Candidate error: too few fields")
+	}
+	c := new(Candidate)
+	c.Foundation = fields[0]
+	component, err := strconv.Atoi(fields[1])
+	if err != nil || component < 1 || component > 256 {
+		return nil, errors.New("Candidate error: invalid component " + fields[1])
+	}
+	c.Component = component
+	c.Protocol = strings.ToLower(fields[2])
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return nil, errors.New("Candidate error: invalid priority " + fields[3])
+	}
+	c.Priority = uint32(priority)
+	c.Addr, err = parseCandidateAddr(fields[4], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	c.Type = -1
+	for t, name := range candidateTypeStr {
+		if name == fields[7] {
+			c.Type = t
+		}
+	}
+	if c.Type < 0 {
+		return nil, errors.New("Candidate error: unknown type " + fields[7])
+	}
+	var raddr, rport string
+	for i := 8; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "raddr":
+			raddr = fields[i+1]
+		case "rport":
+			rport = fields[i+1]
+		}
+	}
+	if raddr != "" && rport != "" {
+		c.RelatedAddr, err = parseCandidateAddr(raddr, rport)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func parseCandidateAddr(ip, port string) (*Host, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, errors.New("Candidate error: invalid address " + ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("Candidate error: invalid port " + port)
+	}
+	return newHostFromUDPAddr(&net.UDPAddr{IP: addr, Port: int(p)}), nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestCandidatePriority(t *testing.T) {
+	if p := candidatePriority(CandidateHost, 65535, 1); p != 2130706431 {
+		t.Errorf("candidatePriority error: get %d", p)
+	}
+	if p := candidatePriority(CandidateServerReflexive, 65535, 1); p != 1694498815 {
+		t.Errorf("candidatePriority error: get %d", p)
+	}
+}
+
+func TestCandidateSDP(t *testing.T) {
+	base := newHostFromStr("192.168.0.2:5000")
+	addr := newHostFromStr("203.0.113.7:61000")
+	c := newCandidate(CandidateServerReflexive, addr, base, "stun.example.org:3478", 1, 65535)
+	line := c.SDP()
+	p, err := ParseCandidate(line)
+	if err != nil {
+		t.Fatalf("ParseCandidate error: %v", err)
+	}
+	if p.SDP() != line {
+		t.Errorf("ParseCandidate error: expected %q, get %q", line, p.SDP())
+	}
+	if p.Type != CandidateServerReflexive || p.RelatedAddr.String() != base.String() {
+		t.Errorf("ParseCandidate error: %v", p)
+	}
+	p, err = ParseCandidate("candidate:1 1 UDP 2122260223 [2001:db8::1] 5000 typ host generation 0")
+	if err == nil {
+		t.Errorf("ParseCandidate error: bracketed address accepted")
+	}
+	p, err = ParseCandidate("candidate:1 1 UDP 2122260223 2001:db8::1 5000 typ host generation 0")
+	if err != nil {
+		t.Fatalf("ParseCandidate error: %v", err)
+	}
+	if p.Addr.Family() != attributeFamilyIPV6 || p.Protocol != "udp" || p.RelatedAddr != nil {
+		t.Errorf("ParseCandidate error: %v", p)
+	}
+	for _, s := range []string{"", "candidate:1 1 udp", "candidate:1 1 udp 1 host 5000 typ host",
+		"candidate:1 1 udp 1 10.0.0.1 5000 typ unknown"} {
+		if _, err := ParseCandidate(s); err == nil {
+			t.Errorf("ParseCandidate error: %q accepted", s)
+		}
+	}
+}
+
+func TestGatherHost(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	var candidates []*Candidate
+	g := NewGatherer(conn)
+	g.SetCandidateHandler(func(c *Candidate) {
+		candidates = append(candidates, c)
+	})
+	if err := g.Gather(); err != nil {
+		t.Fatalf("Gather error: %v", err)
+	}
+	if len(candidates) != 2 || candidates[1] != nil {
+		t.Fatalf("Gather error: %v", candidates)
+	}
+	if candidates[0].Type != CandidateHost || candidates[0].Addr.String() != conn.LocalAddr().String() {
+		t.Errorf("Gather error: %v", candidates[0])
+	}
+}
+
+func TestGatherServerReflexive(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+	defer conn.Close()
+	var candidates []*Candidate
+	// The second server is unreachable, and the third one is the first
+	// one again, which gives the same candidate.
+	g := NewGatherer(conn, testServerAddr, "1.0.0.9:3478", testServerAddr)
+	g.client.timeout = 10
+	g.client.numRetransmit = 3
+	g.SetCandidateHandler(func(c *Candidate) {
+		candidates = append(candidates, c)
+	})
+	if err := g.Gather(); err != nil {
+		t.Fatalf("Gather error: %v", err)
+	}
+	if len(candidates) != 3 || candidates[2] != nil {
+		t.Fatalf("Gather error: %v", candidates)
+	}
+	if c := candidates[0]; c.Type != CandidateHost || c.Addr.String() != "10.0.0.2:5000" {
+		t.Errorf("Gather error: host candidate %v", c)
+	}
+	c := candidates[1]
+	if c.Type != CandidateServerReflexive || c.Addr.String() != "2.0.0.1:5000" ||
+		c.RelatedAddr == nil || c.RelatedAddr.String() != "10.0.0.2:5000" {
+		t.Errorf("Gather error: server reflexive candidate %v", c)
+	}
+}
+
+func TestGatherWildcard(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	s := NewServer([2][2]net.PacketConn{{serverConn}})
+	go s.Serve()
+	defer s.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	var candidates []*Candidate
+	g := NewGatherer(conn, serverConn.LocalAddr().String())
+	g.SetCandidateHandler(func(c *Candidate) {
+		candidates = append(candidates, c)
+	})
+	if err := g.Gather(); err != nil {
+		t.Skipf("Gather error: %v", err)
+	}
+	var srflx *Candidate
+	hosts := make(map[string]*Candidate)
+	for _, c := range candidates {
+		if c == nil {
+			continue
+		}
+		switch c.Type {
+		case CandidateHost:
+			hosts[c.Addr.String()] = c
+		case CandidateServerReflexive:
+			srflx = c
+		}
+	}
+	if srflx == nil {
+		t.Fatalf("Gather error: no server reflexive candidate in %v", candidates)
+	}
+	// The base is a reported host candidate, not the wildcard address,
+	// and shares its foundation with the server reflexive candidates of
+	// the same base.
+	base := hosts[srflx.RelatedAddr.String()]
+	if base == nil || net.ParseIP(srflx.RelatedAddr.IP()).IsUnspecified() {
+		t.Fatalf("Gather error: related address %v is not a host candidate of %v", srflx.RelatedAddr, candidates)
+	}
+	if f := candidateFoundation(CandidateServerReflexive, base.Addr, serverConn.LocalAddr().String()); srflx.Foundation != f {
+		t.Errorf("Gather error: foundation %s, want %s", srflx.Foundation, f)
+	}
+	if strings.Contains(srflx.SDP(), "raddr 0.0.0.0") {
+		t.Errorf("Gather error: %s", srflx.SDP())
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Constants of the pcapng format and of the synthetic IP and UDP headers.
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterfaceDesc    = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngLinkTypeRaw      = 101
+	pcapngProtocolUDP      = 17
+	pcapngDefaultTTL       = 64
+	pcapngIPv4HeaderLength = 20
+	pcapngIPv6HeaderLength = 40
+	pcapngUDPHeaderLength  = 8
+)
+
+// pcapWriter writes datagrams as a pcapng file, in which each datagram is
+// wrapped by synthetic IP and UDP headers so that Wireshark dissects it.
+type pcapWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	started bool
+}
+
+func newPcapWriter(w io.Writer) *pcapWriter {
+	return &pcapWriter{w: w}
+}
+
+// writeDatagram records a datagram from src to dst, received or sent at t.
+func (p *pcapWriter) writeDatagram(t time.Time, src, dst net.Addr, payload []byte) error {
+	srcAddr, err1 := net.ResolveUDPAddr("udp", src.String())
+	dstAddr, err2 := net.ResolveUDPAddr("udp", dst.String())
+	if err1 != nil {
+		return err1
+	}
+	if err2 != nil {
+		return err2
+	}
+	data := ipPacket(srcAddr, dstAddr, payload)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.started {
+		if _, err := p.w.Write(pcapngHeader()); err != nil {
+			return err
+		}
+		p.started = true
+	}
+	_, err := p.w.Write(pcapngPacket(t, data))
+	return err
+}
+
+// pcapngHeader returns the section header block followed by the description
+// of the only interface.
+func pcapngHeader() []byte {
+	b := make([]byte, 28+20)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], pcapngSectionHeader)
+	le.PutUint32(b[4:], 28)
+	le.PutUint32(b[8:], pcapngByteOrderMagic)
+	le.PutUint16(b[12:], 1) // major version
+	le.PutUint16(b[14:], 0) // minor version
+	le.PutUint64(b[16:], ^uint64(0))
+	le.PutUint32(b[24:], 28)
+	// The default timestamp resolution is microseconds, and the snapshot
+	// length 0 means no limit.
+	le.PutUint32(b[28:], pcapngInterfaceDesc)
+	le.PutUint32(b[32:], 20)
+	le.PutUint16(b[36:], pcapngLinkTypeRaw)
+	le.PutUint32(b[44:], 20)
+	return b
+}
+
+func pcapngPacket(t time.Time, data []byte) []byte {
+	padded := int(align(uint16(len(data))))
+	length := 32 + padded
+	b := make([]byte, length)
+	le := binary.LittleEndian
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	le.PutUint32(b[0:], pcapngEnhancedPacket)
+	le.PutUint32(b[4:], uint32(length))
+	le.PutUint32(b[8:], 0) // interface ID
+	le.PutUint32(b[12:], uint32(ts>>32))
+	le.PutUint32(b[16:], uint32(ts))
+	le.PutUint32(b[20:], uint32(len(data)))
+	le.PutUint32(b[24:], uint32(len(data)))
+	copy(b[28:], data)
+	le.PutUint32(b[length-4:], uint32(length))
+	return b
+}
+
+// ipPacket wraps the payload with IP and UDP headers. The local address of a
+// socket bound to the wildcard address is unspecified, which is replaced by
+// the unspecified address of the family of the peer. If the families of the
+// addresses still differ, which happens on dual-stack sockets, the
+// unspecified address of the family of dst is used as the source.
+func ipPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	udpLength := pcapngUDPHeaderLength + len(payload)
+	srcAddr, dstAddr := unspecifiedAs(src.IP, dst.IP), unspecifiedAs(dst.IP, src.IP)
+	srcIP, dstIP := srcAddr.To4(), dstAddr.To4()
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = srcAddr.To16(), dstAddr.To16()
+		if srcAddr.To4() != nil || srcIP == nil {
+			srcIP = net.IPv6unspecified
+		}
+		if dstIP == nil {
+			dstIP = net.IPv6unspecified
+		}
+	}
+	var b []byte
+	if len(dstIP) == net.IPv4len {
+		b = make([]byte, pcapngIPv4HeaderLength+udpLength)
+		b[0] = 0x45 // version 4, header length 5 words
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		binary.BigEndian.PutUint16(b[6:], 0x4000) // don't fragment
+		b[8] = pcapngDefaultTTL
+		b[9] = pcapngProtocolUDP
+		copy(b[12:16], srcIP)
+		copy(b[16:20], dstIP)
+		binary.BigEndian.PutUint16(b[10:], ^fold(checksum(0, b[:pcapngIPv4HeaderLength])))
+	} else {
+		b = make([]byte, pcapngIPv6HeaderLength+udpLength)
+		b[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(b[4:], uint16(udpLength))
+		b[6] = pcapngProtocolUDP
+		b[7] = pcapngDefaultTTL
+		copy(b[8:24], srcIP)
+		copy(b[24:40], dstIP)
+	}
+	udp := b[len(b)-udpLength:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLength))
+	copy(udp[8:], payload)
+	// The checksum covers a pseudo header of the addresses, protocol and
+	// length, besides the UDP header and payload.
+	sum := checksum(0, srcIP)
+	sum = checksum(sum, dstIP)
+	sum += pcapngProtocolUDP + uint32(udpLength)
+	sum = checksum(sum, udp)
+	csum := ^fold(sum)
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], csum)
+	return b
+}
+
+// unspecifiedAs returns the unspecified address of the family of peer if ip
+// is unspecified, and ip otherwise.
+func unspecifiedAs(ip, peer net.IP) net.IP {
+	if len(ip) != 0 && !ip.IsUnspecified() {
+		return ip
+	}
+	if peer.To4() != nil {
+		return net.IPv4zero
+	}
+	return net.IPv6unspecified
+}
+
+// checksum adds b to the one's complement sum of 16-bit words.
+func checksum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return uint32(fold(sum))
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestCapture(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn, err := n.ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	c := newTestClient(conn)
+	c.SetCaptureWriter(&buf)
+	result, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("Discover error: %v", err)
+	}
+
+	le := binary.LittleEndian
+	b := buf.Bytes()
+	if len(b) < 48 || le.Uint32(b) != pcapngSectionHeader || le.Uint32(b[8:]) != pcapngByteOrderMagic {
+		t.Fatalf("Capture error: no section header block")
+	}
+	if le.Uint32(b[28:]) != pcapngInterfaceDesc || le.Uint16(b[36:]) != pcapngLinkTypeRaw {
+		t.Fatalf("Capture error: no interface description block")
+	}
+	var sent, received int
+	for b = b[48:]; len(b) > 0; {
+		length := le.Uint32(b[4:])
+		if le.Uint32(b) != pcapngEnhancedPacket || length%4 != 0 || le.Uint32(b[length-4:]) != length {
+			t.Fatalf("Capture error: malformed enhanced packet block")
+		}
+		ip := b[28 : 28+le.Uint32(b[20:])]
+		if fold(checksum(0, ip[:pcapngIPv4HeaderLength])) != 0xffff {
+			t.Errorf("Capture error: bad IPv4 header checksum")
+		}
+		src := net.IP(ip[12:16]).String()
+		udp := ip[pcapngIPv4HeaderLength:]
+		if _, err := newPacketFromBytes(udp[pcapngUDPHeaderLength:]); err != nil {
+			t.Errorf("Capture error: payload is not STUN: %v", err)
+		}
+		if src == "3.0.0.1" && binary.BigEndian.Uint16(udp) == 5000 {
+			sent++
+		} else {
+			received++
+		}
+		b = b[length:]
+	}
+	requests, responses := 0, 0
+	for _, test := range result.Tests {
+		requests += test.Attempts
+		if test.Responded {
+			responses++
+		}
+	}
+	if sent != requests || received != responses {
+		t.Errorf("Capture error: %d sent and %d received, expected %d and %d",
+			sent, received, requests, responses)
+	}
+}
+
+func TestIPPacketIPv6(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+	dst := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 3478}
+	b := ipPacket(src, dst, []byte{1, 2, 3})
+	if len(b) != pcapngIPv6HeaderLength+pcapngUDPHeaderLength+3 || b[0]>>4 != 6 {
+		t.Fatalf("IPv6 packet error: %x", b)
+	}
+	// The checksum over the pseudo header and the datagram is all ones.
+	udp := b[pcapngIPv6HeaderLength:]
+	sum := checksum(0, b[8:40])
+	sum += pcapngProtocolUDP + uint32(len(udp))
+	if fold(checksum(sum, udp)) != 0xffff {
+		t.Errorf("IPv6 packet error: bad UDP checksum")
+	}
+}
+
+func TestCaptureWildcard(t *testing.T) {
+	for _, test := range []struct {
+		local, remote string
+		version       byte
+		unspecified   string
+	}{
+		{"[::]:5000", "1.0.0.1:3478", 4, "0.0.0.0"},
+		{"0.0.0.0:5000", "1.0.0.1:3478", 4, "0.0.0.0"},
+		{":5000", "1.0.0.1:3478", 4, "0.0.0.0"},
+		{"0.0.0.0:5000", "[2001:db8::1]:3478", 6, "::"},
+	} {
+		var buf bytes.Buffer
+		w := newPcapWriter(&buf)
+		local, _ := net.ResolveUDPAddr("udp", test.local)
+		remote, _ := net.ResolveUDPAddr("udp", test.remote)
+		if err := w.writeDatagram(time.Now(), local, remote, []byte{1}); err != nil {
+			t.Fatalf("%s: writeDatagram error: %v", test.local, err)
+		}
+		if err := w.writeDatagram(time.Now(), remote, local, []byte{2}); err != nil {
+			t.Fatalf("%s: writeDatagram error: %v", test.local, err)
+		}
+		b := buf.Bytes()[48:]
+		for i, dir := range []struct{ src, dst string }{
+			{test.unspecified, remote.IP.String()},
+			{remote.IP.String(), test.unspecified},
+		} {
+			length := binary.LittleEndian.Uint32(b[4:])
+			ip := b[28 : 28+binary.LittleEndian.Uint32(b[20:])]
+			var src, dst net.IP
+			if ip[0]>>4 == 4 {
+				src, dst = ip[12:16], ip[16:20]
+			} else {
+				src, dst = ip[8:24], ip[24:40]
+			}
+			if ip[0]>>4 != test.version || src.String() != dir.src || dst.String() != dir.dst {
+				t.Errorf("%s: packet %d is IPv%d from %v to %v, expected IPv%d from %s to %s",
+					test.local, i, ip[0]>>4, src, dst, test.version, dir.src, dir.dst)
+			}
+			b = b[length:]
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"fmt"
+	"net"
+)
+
+// ServerCheck is a check of CheckServer.
+type ServerCheck struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// ServerReport is the result of CheckServer.
+type ServerReport struct {
+	Checks  []ServerCheck
+	RFC3489 bool // whether the server supports the discovery of RFC 3489
+	RFC5780 bool // whether the server supports the behavior tests of RFC 5780
+}
+
+// Names of the checks of CheckServer.
+const (
+	CheckBinding          = "Binding response"
+	CheckXorMappedAddress = "XOR-MAPPED-ADDRESS"
+	CheckFingerprint      = "FINGERPRINT"
+	CheckSoftware         = "SOFTWARE"
+	CheckResponseOrigin   = "RESPONSE-ORIGIN"
+	CheckOtherAddress     = "OTHER-ADDRESS"
+	CheckChangedAddress   = "CHANGED-ADDRESS"
+	CheckAlternateAddress = "Response from OTHER-ADDRESS"
+	CheckChangeIP         = "CHANGE-REQUEST IP"
+	CheckChangePort       = "CHANGE-REQUEST port"
+	CheckChangeBoth       = "CHANGE-REQUEST IP and port"
+)
+
+// Passed tells whether the named checks passed.
+func (r *ServerReport) Passed(names ...string) bool {
+	for _, name := range names {
+		found := false
+		for _, check := range r.Checks {
+			if check.Name == name {
+				if !check.Passed {
+					return false
+				}
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ServerReport) add(name string, passed bool, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, ServerCheck{name, passed, fmt.Sprintf(format, args...)})
+}
+
+// CheckServer checks whether the STUN server complies with RFC 3489,
+// RFC 5389 and RFC 5780, which tells whether a NATError of Discover is the
+// fault of the server. Responses to CHANGE-REQUEST come from other
+// addresses, which a NAT of the client may filter, so the checks are only
+// conclusive on a host with a public address or behind a full cone NAT. It
+// returns ErrBlocked if the server does not respond at all. The report is
+// returned even with an error, with the checks which could not run failed.
+func (c *Client) CheckServer() (*ServerReport, error) {
+	r := new(ServerReport)
+	serverUDPAddr, err := c.resolveServer()
+	if err != nil {
+		r.add(CheckBinding, false, "%v", err)
+		return r, err
+	}
+	conn, err := c.connection(serverUDPAddr)
+	if err != nil {
+		r.add(CheckBinding, false, "%v", err)
+		return r, err
+	}
+	if conn != c.conn {
+		defer conn.Close()
+	}
+	resp, err := c.test1(conn, serverUDPAddr)
+	if err != nil || resp == nil {
+		detail := "no response"
+		if err != nil {
+			detail = err.Error()
+		}
+		r.add(CheckBinding, false, "%s", detail)
+		if err == nil {
+			err = ErrBlocked
+		}
+		return r, err
+	}
+	r.add(CheckBinding, true, "from %v", resp.serverAddr)
+	pkt := resp.packet
+	server := newHostFromUDPAddr(serverUDPAddr)
+
+	if h := pkt.getXorMappedAddr(); h != nil {
+		r.add(CheckXorMappedAddress, true, "%v", h)
+	} else {
+		r.add(CheckXorMappedAddress, false, "missing")
+	}
+	switch {
+	case pkt.getAttribute(attributeFingerprint) == nil:
+		r.add(CheckFingerprint, false, "missing")
+	case !pkt.checkFingerprint():
+		r.add(CheckFingerprint, false, "invalid CRC")
+	default:
+		r.add(CheckFingerprint, true, "valid")
+	}
+	if a := pkt.getAttribute(attributeSoftware); a != nil {
+		r.add(CheckSoftware, true, "%q", a.value)
+	} else {
+		r.add(CheckSoftware, false, "missing")
+	}
+	if h := pkt.getRawAddr(attributeResponseOrigin); h == nil {
+		r.add(CheckResponseOrigin, false, "missing")
+	} else if h.String() != resp.serverAddr.String() {
+		r.add(CheckResponseOrigin, false, "%v, but the response came from %v", h, resp.serverAddr)
+	} else {
+		r.add(CheckResponseOrigin, true, "%v", h)
+	}
+	other := checkOtherAddr(r, CheckOtherAddress, pkt.getOtherAddr(), server)
+	changed := checkOtherAddr(r, CheckChangedAddress, pkt.getChangedAddr(), server)
+	if other == nil {
+		other = changed
+	}
+
+	if other == nil {
+		r.add(CheckAlternateAddress, false, "no alternate address")
+	} else if addr, err := net.ResolveUDPAddr("udp", other.String()); err != nil {
+		r.add(CheckAlternateAddress, false, "%v", err)
+	} else {
+		resp, err := c.test1(conn, addr)
+		switch {
+		case err != nil:
+			r.add(CheckAlternateAddress, false, "%v", err)
+		case resp == nil:
+			r.add(CheckAlternateAddress, false, "no response")
+		case resp.serverAddr.String() != other.String():
+			r.add(CheckAlternateAddress, false, "response from %v", resp.serverAddr)
+		default:
+			r.add(CheckAlternateAddress, true, "response from %v", resp.serverAddr)
+		}
+	}
+
+	for _, test := range []struct {
+		name                 string
+		changeIP, changePort bool
+	}{
+		{CheckChangeIP, true, false},
+		{CheckChangePort, false, true},
+		{CheckChangeBoth, true, true},
+	} {
+		resp, err := c.sendBindingReq(conn, serverUDPAddr, test.changeIP, test.changePort)
+		switch {
+		case err != nil:
+			r.add(test.name, false, "%v", err)
+		case resp == nil:
+			r.add(test.name, false, "no response, which the local NAT may have dropped")
+		case resp.errorCode != 0:
+			r.add(test.name, false, "error %d %s", resp.errorCode, resp.errorReason)
+		case !addrCompare(resp.serverAddr, serverUDPAddr, test.changeIP, test.changePort):
+			r.add(test.name, false, "response from %v", resp.serverAddr)
+		case other != nil && test.changeIP && resp.serverAddr.IP() != other.IP():
+			r.add(test.name, false, "response from %v, not the IP of %v", resp.serverAddr, other)
+		case other != nil && test.changePort && resp.serverAddr.Port() != other.Port():
+			r.add(test.name, false, "response from %v, not the port of %v", resp.serverAddr, other)
+		default:
+			r.add(test.name, true, "response from %v", resp.serverAddr)
+		}
+	}
+
+	// The discovery of RFC 3489 sends Test I to CHANGED-ADDRESS as well.
+	r.RFC3489 = r.Passed(CheckBinding, CheckChangedAddress, CheckAlternateAddress, CheckChangePort,
+		CheckChangeBoth)
+	r.RFC5780 = r.Passed(CheckBinding, CheckXorMappedAddress, CheckResponseOrigin, CheckOtherAddress,
+		CheckAlternateAddress, CheckChangeIP, CheckChangePort, CheckChangeBoth)
+	c.logger.Log(LevelInfo, "server checked", "rfc3489", r.RFC3489, "rfc5780", r.RFC5780)
+	return r, nil
+}
+
+// checkOtherAddr checks an alternate address of the server, which must
+// differ in both IP and port, and returns it if it does.
+func checkOtherAddr(r *ServerReport, name string, h *Host, server *Host) *Host {
+	switch {
+	case h == nil:
+		r.add(name, false, "missing")
+	case h.IP() == server.IP() || h.Port() == server.Port():
+		r.add(name, false, "%v does not differ from %v in both IP and port", h, server)
+	default:
+		r.add(name, true, "%v", h)
+		return h
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestCheckServer(t *testing.T) {
+	tests := []struct {
+		broken           string
+		rfc3489, rfc5780 bool
+		failed           []string
+	}{
+		{"", true, true, nil},
+		{"legacy", true, false, []string{CheckXorMappedAddress, CheckFingerprint, CheckSoftware,
+			CheckResponseOrigin, CheckOtherAddress}},
+		{"no other address", false, false, []string{CheckOtherAddress, CheckChangedAddress,
+			CheckAlternateAddress}},
+		{"ignore change", false, false, []string{CheckChangeIP, CheckChangePort, CheckChangeBoth}},
+		// Test I of RFC 3489 goes to CHANGED-ADDRESS too.
+		{"deaf other address", false, false, []string{CheckAlternateAddress}},
+	}
+	for _, test := range tests {
+		n := nattest.NewNetwork()
+		s := newTestServer(t, n)
+		s.legacy = test.broken == "legacy"
+		s.noOtherAddr = test.broken == "no other address"
+		s.ignoreChange = test.broken == "ignore change"
+		s.deafOther = test.broken == "deaf other address"
+		conn, err := n.ListenPacket("3.0.0.1", 5000)
+		if err != nil {
+			t.Fatalf("ListenPacket error: %v", err)
+		}
+		r, err := newTestClient(conn).CheckServer()
+		if err != nil {
+			t.Fatalf("%q: CheckServer error: %v", test.broken, err)
+		}
+		if r.RFC3489 != test.rfc3489 || r.RFC5780 != test.rfc5780 {
+			t.Errorf("%q: CheckServer error: RFC 3489 %v, RFC 5780 %v", test.broken, r.RFC3489, r.RFC5780)
+		}
+		failed := make(map[string]bool)
+		for _, name := range test.failed {
+			failed[name] = true
+		}
+		for _, check := range r.Checks {
+			if check.Passed == failed[check.Name] {
+				t.Errorf("%q: check %s passed %v: %s", test.broken, check.Name, check.Passed, check.Detail)
+			}
+		}
+	}
+
+	n := nattest.NewNetwork()
+	s := newTestServer(t, n)
+	atomic.StoreInt32(&s.silent, 1)
+	conn, err := n.ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	if r, err := newTestClient(conn).CheckServer(); err != ErrBlocked || r.Passed(CheckBinding) {
+		t.Errorf("CheckServer error: %v without response", err)
+	}
+
+	// The report tells why the server could not be checked.
+	c := newTestClient(conn)
+	c.SetServerAddr("1.0.0.1:notaport")
+	if r, err := c.CheckServer(); err == nil || r == nil || len(r.Checks) != 1 || r.Passed(CheckBinding) ||
+		r.Checks[0].Detail != err.Error() {
+		t.Errorf("CheckServer error: %v, report %v with an invalid address", err, r)
+	}
+}
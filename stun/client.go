@@ -15,10 +15,14 @@
 package stun
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
 // Client is a STUN client, which can be set STUN server address and is used
@@ -29,7 +33,25 @@ type Client struct {
 	localPort    int
 	softwareName string
 	conn         net.PacketConn
-	logger       *Logger
+	logger       EventLogger
+	capture      *pcapWriter
+	metrics      Metrics
+	cache        *Cache
+	iface        string
+	protocol     Protocol
+	detected     int32      // protocol detected in the auto mode, set atomically
+	secretMu     sync.Mutex // guards username and password
+	username     string
+	password     []byte // from ObtainSharedSecret, nil if unauthenticated
+	strict       bool
+	// Sources of interfaces and sockets, which tests replace.
+	interfaces InterfaceSource
+	listen     func(laddr *net.UDPAddr) (net.PacketConn, error)
+	dial       func(network, address string) (net.Conn, error)
+	rtt        rttTable
+	// Retransmission parameters, which tests may shorten.
+	timeout       int
+	numRetransmit int
 }
 
 // NewClient returns a client without network connection. The network
@@ -38,6 +60,12 @@ func NewClient() *Client {
 	c := new(Client)
 	c.SetSoftwareName(DefaultSoftwareName)
 	c.logger = NewLogger()
+	c.metrics = nopMetrics{}
+	c.interfaces = systemInterfaces{}
+	c.listen = listenUDP
+	c.dial = net.Dial
+	c.timeout = defaultTimeout
+	c.numRetransmit = numRetransmit
 	return c
 }
 
@@ -48,29 +76,73 @@ func NewClientWithConnection(conn net.PacketConn) *Client {
 	c.conn = conn
 	c.SetSoftwareName(DefaultSoftwareName)
 	c.logger = NewLogger()
+	c.metrics = nopMetrics{}
+	c.interfaces = systemInterfaces{}
+	c.listen = listenUDP
+	c.dial = net.Dial
+	c.timeout = defaultTimeout
+	c.numRetransmit = numRetransmit
 	return c
 }
 
 // SetVerbose sets the client to be in the verbose mode, which prints
-// information in the discover process.
+// information in the discover process. It has no effect if the logger has
+// been replaced by SetLogger.
 func (c *Client) SetVerbose(v bool) {
-	c.logger.SetDebug(v)
+	if l, ok := c.logger.(*Logger); ok {
+		l.SetDebug(v)
+	}
 }
 
 // SetVVerbose sets the client to be in the double verbose mode, which prints
-// information and packet in the discover process.
+// information and packet in the discover process. It has no effect if the
+// logger has been replaced by SetLogger.
 func (c *Client) SetVVerbose(v bool) {
-	c.logger.SetInfo(v)
+	if l, ok := c.logger.(*Logger); ok {
+		l.SetInfo(v)
+	}
+}
+
+// SetLogger replaces the default logger, which prints to the standard output
+// in the verbose modes. Use NewSlogLogger to log through log/slog, or nil to
+// disable logging.
+func (c *Client) SetLogger(l EventLogger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	c.logger = l
+}
+
+// SetMetrics sets the receiver of the measurements of the client, such as
+// the one returned by NewPrometheusMetrics. Set nil to stop measuring.
+func (c *Client) SetMetrics(m Metrics) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	c.metrics = m
+}
+
+// SetCaptureWriter sets the writer to which every datagram sent and received
+// is written in the pcapng format, which Wireshark opens directly. Set nil to
+// stop capturing.
+func (c *Client) SetCaptureWriter(w io.Writer) {
+	if w == nil {
+		c.capture = nil
+		return
+	}
+	c.capture = newPcapWriter(w)
 }
 
 // SetServerHost allows user to set the STUN hostname and port.
 func (c *Client) SetServerHost(host string, port int) {
-	c.serverAddr = net.JoinHostPort(host, strconv.Itoa(port))
+	c.SetServerAddr(net.JoinHostPort(host, strconv.Itoa(port)))
 }
 
 // SetServerAddr allows user to set the transport layer STUN server address.
+// The protocol detected from the previous server is forgotten.
 func (c *Client) SetServerAddr(address string) {
 	c.serverAddr = address
+	atomic.StoreInt32(&c.detected, int32(ProtocolAuto))
 }
 
 // SetLocalPort allows user to set the local port to send request.
@@ -83,6 +155,14 @@ func (c *Client) SetLocalIP(ip string) {
 	c.localIP = ip
 }
 
+// SetInterface allows user to send requests from the address of the named
+// network interface, of the same family as the server address. It has no
+// effect if the local IP is set. Whether the requests leave through the
+// interface depends on the routing of the system.
+func (c *Client) SetInterface(name string) {
+	c.iface = name
+}
+
 // SetSoftwareName allows user to set the name of the software, which is used
 // for logging purpose (NOT used in the current implementation).
 func (c *Client) SetSoftwareName(name string) {
@@ -92,92 +172,207 @@ func (c *Client) SetSoftwareName(name string) {
 // Discover contacts the STUN server and gets the response of NAT type, host
 // for UDP punching.
 func (c *Client) Discover() (NATType, *Host, error) {
-	if c.serverAddr == "" {
-		c.SetServerAddr(DefaultServerAddr)
-	}
-	serverUDPAddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	result, err := c.DiscoverResult()
+	return result.NAT, result.Host, err
+}
+
+// DiscoverResult works like Discover, but also returns every test performed
+// and the reason of the NAT type, which explain the result. The result is
+// never nil.
+func (c *Client) DiscoverResult() (*DiscoveryResult, error) {
+	result := &DiscoveryResult{NAT: NATError}
+	serverUDPAddr, err := c.resolveServer()
 	if err != nil {
-		return NATError, nil, err
+		return result, err
+	}
+	if cached := c.cachedDiscover(serverUDPAddr.String()); cached != nil {
+		return cached, nil
 	}
 	// Use the connection passed to the client if it is not nil, otherwise
 	// create a connection and close it at the end.
-	conn := c.conn
-	if conn == nil {
-		var laddr *net.UDPAddr
-
-		if c.localPort != 0  || c.localIP != "" {
-			var address = fmt.Sprintf("%s:%d", c.localIP, c.localPort)
-
-			laddr, err = net.ResolveUDPAddr("udp", address)
-			if err != nil {
-				return NATError, nil, err
-			}
-
-			c.logger.Debugln("Local listen address: " + address)
-		}
-
-		conn, err = net.ListenUDP("udp", laddr)
-		if err != nil {
-			return NATError, nil, err
-		}
+	conn, err := c.connection(serverUDPAddr)
+	if err != nil {
+		return result, err
+	}
+	if conn != c.conn {
 		defer conn.Close()
 	}
-	return c.discover(conn, serverUDPAddr)
+	result, err = c.discoverResult(conn, serverUDPAddr)
+	// A blocked result is not cached, since the server may be unreachable
+	// for a moment.
+	if err == nil && result.NAT != NATBlocked {
+		c.cacheDiscover(serverUDPAddr.String(), result)
+	}
+	return result, err
+}
+
+// discoverResult runs the discover process on conn.
+func (c *Client) discoverResult(conn net.PacketConn, server *net.UDPAddr) (*DiscoveryResult, error) {
+	var err error
+	result := &DiscoveryResult{NAT: NATError}
+	result.NAT, result.Host, err = c.discover(conn, server, result)
+	if err == nil {
+		c.metrics.NATType(result.NAT)
+	}
+	c.logger.Log(LevelInfo, "classification", "nat", result.NAT, "mapped", result.Host,
+		"reason", result.Reason, "err", err)
+	return result, err
 }
 
 // BehaviorTest performs STUN behavior tests.
 func (c *Client) BehaviorTest() (*NATBehavior, error) {
-	if c.serverAddr == "" {
-		c.SetServerAddr(DefaultServerAddr)
-	}
-	serverUDPAddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	serverUDPAddr, err := c.resolveServer()
 	if err != nil {
 		return nil, err
 	}
+	if cached := c.cachedBehavior(serverUDPAddr.String()); cached != nil {
+		return cached, nil
+	}
 	// Use the connection passed to the client if it is not nil, otherwise
 	// create a connection and close it at the end.
-	conn := c.conn
-	if conn == nil {
-		var laddr *net.UDPAddr
-		if c.localPort != 0  || c.localIP != "" {
-			var address = fmt.Sprintf("%s:%d", c.localIP, c.localPort)
-
-			laddr, err = net.ResolveUDPAddr("udp", address)
-			if err != nil {
-				return nil, err
-			}
-
-			c.logger.Debugln("Local listen address: " + address)
-		}
-		conn, err = net.ListenUDP("udp", laddr)
-		if err != nil {
-			return nil, err
-		}
+	conn, err := c.connection(serverUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if conn != c.conn {
 		defer conn.Close()
 	}
-	return c.behaviorTest(conn, serverUDPAddr)
+	natBehavior, err := c.behaviorTest(conn, serverUDPAddr)
+	if err == nil && natBehavior != nil {
+		c.metrics.NATBehavior(natBehavior)
+		c.cacheBehavior(serverUDPAddr.String(), natBehavior)
+	}
+	if natBehavior != nil {
+		c.logger.Log(LevelInfo, "classification", "mapping", natBehavior.MappingType,
+			"filtering", natBehavior.FilteringType, "err", err)
+	}
+	return natBehavior, err
 }
 
 // Keepalive sends and receives a bind request, which ensures the mapping stays open
 // Only applicable when client was created with a connection.
+// It may be called by several goroutines at once. The cached results of the
+// client are dropped if the mapped address differs from the cached one.
 func (c *Client) Keepalive() (*Host, error) {
+	return c.keepalive(context.Background())
+}
+
+// keepalive works like Keepalive, but gives up when ctx is done.
+func (c *Client) keepalive(ctx context.Context) (*Host, error) {
 	if c.conn == nil {
 		return nil, errors.New("no connection available")
 	}
-	if c.serverAddr == "" {
-		c.SetServerAddr(DefaultServerAddr)
-	}
-	serverUDPAddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	serverUDPAddr, err := c.resolveServer()
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.test1(c.conn, serverUDPAddr)
+	pkt, err := c.newBindingReq(false, false)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.exchangeContext(ctx, pkt, c.conn, c.conn, serverUDPAddr)
 	if err != nil {
 		return nil, err
 	}
 	if resp == nil || resp.packet == nil {
 		return nil, errors.New("failed to contact")
 	}
+	if resp.mappedAddr == nil {
+		return nil, errors.New("Server error: no mapped address")
+	}
+	c.checkCachedMapping(serverUDPAddr.String(), resp.mappedAddr)
 	return resp.mappedAddr, nil
 }
+
+// ResponseAddressTest sends a Binding request from the client's connection
+// with the RESPONSE-ADDRESS attribute of RFC 3489, which asks the server to
+// send the response to the mapped address of in. It returns the address the
+// server reports in REFLECTED-FROM, which is the mapped address of the
+// client's connection. Servers only honour RESPONSE-ADDRESS in authenticated
+// requests, so ObtainSharedSecret must be called first.
+func (c *Client) ResponseAddressTest(in net.PacketConn) (*Host, error) {
+	serverUDPAddr, err := c.resolveServer()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.test1(in, serverUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, ErrBlocked
+	}
+	if resp.mappedAddr == nil {
+		return nil, errors.New("Server error: no mapped address")
+	}
+	conn, err := c.connection(serverUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if conn != c.conn {
+		defer conn.Close()
+	}
+	target := &net.UDPAddr{IP: net.ParseIP(resp.mappedAddr.IP()), Port: int(resp.mappedAddr.Port())}
+	pkt, err := c.newBindingReq(false, false, *newRawAddrAttribute(attributeResponseAddress, target))
+	if err != nil {
+		return nil, err
+	}
+	resp, err = c.exchange(pkt, conn, in, serverUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New("Server error: no response at RESPONSE-ADDRESS")
+	}
+	if resp.reflected == nil {
+		return nil, errors.New("Server error: no reflected from address")
+	}
+	return resp.reflected, nil
+}
+
+// resolveServer resolves the server address, which is the default one if it
+// is not set.
+func (c *Client) resolveServer() (*net.UDPAddr, error) {
+	addr := c.serverAddr
+	if addr == "" {
+		addr = DefaultServerAddr
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+// connection returns the connection passed to the client, or a new one on
+// the local address set, which the caller must close. The address of an
+// interface is of the family of server.
+func (c *Client) connection(server *net.UDPAddr) (net.PacketConn, error) {
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	localIP := c.localIP
+	if localIP == "" && c.iface != "" {
+		addrs, err := c.interfaceAddrs(server)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if a.Name == c.iface {
+				localIP = a.Net.IP.String()
+				break
+			}
+		}
+		if localIP == "" {
+			return nil, fmt.Errorf("no usable address on interface %s", c.iface)
+		}
+	}
+	var laddr *net.UDPAddr
+	if c.localPort != 0 || localIP != "" {
+		var address = net.JoinHostPort(localIP, strconv.Itoa(c.localPort))
+		var err error
+		laddr, err = net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		c.logger.Log(LevelDebug, "local listen address", "addr", address)
+	}
+	return c.listen(laddr)
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Consent freshness of RFC 7675.
+const (
+	// DefaultConsentInterval is the average time between two consent
+	// checks, which is randomized by 20% each time.
+	DefaultConsentInterval = 5 * time.Second
+	// DefaultConsentTimeout is how long consent lasts without a response.
+	DefaultConsentTimeout = 30 * time.Second
+)
+
+// ErrConsentExpired is returned by ConsentManager.Run when the peer stops
+// answering the consent checks.
+var ErrConsentExpired = errors.New("consent expired")
+
+// ConsentManager checks that the peer of an established path still wants to
+// receive data, as RFC 7675 requires before sending to an address learned
+// by Punch. It sends connectivity checks authenticated with the credentials
+// of the peer as the controlling agent, so that an ICE-lite peer answers them
+// too, and answers the checks of the peer, which runs a consent manager of
+// its own. Consent expires when none of our checks is answered for the
+// timeout. The application must then stop sending to the peer.
+type ConsentManager struct {
+	client     *Client
+	peer       *Peer
+	addr       *Host
+	interval   time.Duration
+	timeout    time.Duration
+	granted    int32 // set atomically
+	expired    chan struct{}
+	sleep      func(ctx context.Context, d time.Duration) error
+	rand       *rand.Rand
+	tieBreaker uint64 // of ICE-CONTROLLING in the checks
+}
+
+// NewConsentManager returns a consent manager of the path from the
+// connection of the client to addr, which is returned by Punch. The client
+// must have been created by NewClientWithConnection on a DemuxConn, so that
+// the responses and the checks of the peer reach the consent manager while
+// the application reads the connection. Consent is granted until the first
+// check fails for the timeout.
+func NewConsentManager(c *Client, peer *Peer, addr *Host) *ConsentManager {
+	m := new(ConsentManager)
+	m.client = c
+	m.peer = peer
+	m.addr = addr
+	m.interval = DefaultConsentInterval
+	m.timeout = DefaultConsentTimeout
+	m.granted = 1
+	m.expired = make(chan struct{})
+	m.sleep = sleepContext
+	m.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	m.tieBreaker = m.rand.Uint64()
+	return m
+}
+
+// SetInterval sets the average time between two consent checks.
+func (m *ConsentManager) SetInterval(d time.Duration) {
+	m.interval = d
+}
+
+// SetTimeout sets how long consent lasts without a response.
+func (m *ConsentManager) SetTimeout(d time.Duration) {
+	m.timeout = d
+}
+
+// Granted tells whether the peer still consents to receive data.
+func (m *ConsentManager) Granted() bool {
+	return atomic.LoadInt32(&m.granted) != 0
+}
+
+// Expired returns a channel which is closed when consent expires.
+func (m *ConsentManager) Expired() <-chan struct{} {
+	return m.expired
+}
+
+// Run sends consent checks until consent expires, when it returns
+// ErrConsentExpired, or until ctx is done, when it returns the error of ctx.
+// It can only be called once.
+func (m *ConsentManager) Run(ctx context.Context) error {
+	c := m.client
+	if c.conn == nil {
+		return errors.New("no connection available")
+	}
+	// The peer keeps checking our consent for as long as we check its.
+	if d, ok := c.conn.(*DemuxConn); ok {
+		d.SetRequestHandler(m.Handle)
+		defer d.SetRequestHandler(nil)
+	}
+	addr, err := net.ResolveUDPAddr("udp", m.addr.TransportAddr())
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(m.timeout)
+	for {
+		// RFC 7675: the interval is randomized over 0.8 to 1.2 times
+		// the base interval, so that checks do not synchronize.
+		wait := time.Duration(float64(m.interval) * (0.8 + 0.4*m.rand.Float64()))
+		if d := time.Until(deadline); d < wait {
+			wait = d
+		}
+		if err := m.sleep(ctx, wait); err != nil {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			atomic.StoreInt32(&m.granted, 0)
+			close(m.expired)
+			c.logger.Log(LevelWarn, "consent expired", "peer", addr)
+			return ErrConsentExpired
+		}
+		ok, err := m.check(ctx, addr, time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		if ok {
+			deadline = time.Now().Add(m.timeout)
+			c.logger.Log(LevelDebug, "consent refreshed", "peer", addr)
+		}
+	}
+}
+
+// Handle answers b received from addr if it is a check of the peer, and
+// tells whether it is. Run calls it for the checks received by a DemuxConn;
+// an application reading another connection passes its datagrams to it.
+func (m *ConsentManager) Handle(b []byte, addr net.Addr) bool {
+	pkt, err := newPacketFromBytes(b)
+	if err != nil || pkt.types != typeBindingRequest || !pkt.checkFingerprint() {
+		return false
+	}
+	from, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return false
+	}
+	ok, err := answerCheck(m.client.conn, m.peer.Username, []byte(m.peer.Password), pkt, from)
+	if err != nil {
+		m.client.logger.Log(LevelDebug, "consent response failed", "peer", addr, "err", err)
+	}
+	return ok
+}
+
+// check sends a consent check to addr, which is given up within limit or
+// when ctx is done, and tells whether the peer answered it.
+func (m *ConsentManager) check(ctx context.Context, addr *net.UDPAddr, limit time.Duration) (bool, error) {
+	c := m.client
+	pkt, err := newCheckRequest(m.peer, false, m.tieBreaker)
+	if err != nil {
+		return false, err
+	}
+	// Retransmit like any request, but no longer than the interval, so
+	// that the checks do not overlap and stop when consent expires.
+	if d := m.interval * 4 / 5; d < limit {
+		limit = d
+	}
+	timeout := c.rtt.rto(addr.String(), time.Duration(c.timeout)*time.Millisecond)
+	attempts := 1
+	for t, total := timeout, timeout; attempts < c.numRetransmit; attempts++ {
+		if t < maxTimeout*time.Millisecond {
+			t *= 2
+		}
+		if total += t; total > limit {
+			break
+		}
+	}
+	resp, err := c.transact(ctx, pkt, c.conn, c.conn, addr, attempts, timeout)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil {
+		// Neither a failed write nor an invalid response refreshes
+		// consent, but they may be transient, so only the timeout
+		// ends it.
+		c.logger.Log(LevelDebug, "consent check failed", "peer", addr, "err", err)
+		return false, nil
+	}
+	if resp == nil {
+		return false, nil
+	}
+	return resp.errorCode == 0 && resp.serverAddr.String() == addr.String() &&
+		resp.packet.checkIntegrity([]byte(m.peer.Password)), nil
+}
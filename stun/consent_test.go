@@ -0,0 +1,89 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestConsent(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	a := NewDemuxConn(listenBehindNAT(t, n, "2.0.0.1", nattest.Config{Filtering: apd}))
+	defer a.Close()
+	b := NewDemuxConn(listenBehindNAT(t, n, "2.0.0.2", nattest.Config{Filtering: apd}))
+	defer b.Close()
+	clientA, clientB := newTestClient(a), newTestClient(b)
+	hostA, err := clientA.Keepalive()
+	if err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	hostB, err := clientB.Keepalive()
+	if err != nil {
+		t.Fatalf("Keepalive error: %v", err)
+	}
+	// Both ends use the same Peer credentials for Punch and for consent.
+	peerOfA := &Peer{hostB, NATPortRestricted, "user", "pass"}
+	peerOfB := &Peer{hostA, NATPortRestricted, "user", "pass"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	gotB, gotA, errA, errB := punchPair(ctx, a, b, peerOfA, peerOfB)
+	cancel()
+	if errA != nil || errB != nil {
+		t.Fatalf("Punch error: %v, %v", errA, errB)
+	}
+
+	newManager := func(c *Client, peer *Peer, addr *Host) *ConsentManager {
+		m := NewConsentManager(c, peer, addr)
+		m.SetInterval(20 * time.Millisecond)
+		m.SetTimeout(200 * time.Millisecond)
+		return m
+	}
+	managerA := newManager(clientA, peerOfA, gotB)
+	managerB := newManager(clientB, peerOfB, gotA)
+	doneA, doneB := make(chan error, 1), make(chan error, 1)
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	go func() { doneA <- managerA.Run(context.Background()) }()
+	go func() { doneB <- managerB.Run(ctxB) }()
+
+	// Each end answers the checks of the other, which keeps consent
+	// beyond the timeout on both.
+	time.Sleep(600 * time.Millisecond)
+	if !managerA.Granted() || !managerB.Granted() {
+		t.Fatalf("consent error: granted %v and %v while both run", managerA.Granted(), managerB.Granted())
+	}
+
+	// b stops, so its checks are not answered anymore.
+	stopB()
+	if err := <-doneB; err != context.Canceled {
+		t.Errorf("Run error: %v", err)
+	}
+	stopped := time.Now()
+	select {
+	case <-managerA.Expired():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("consent error: not expired")
+	}
+	if d := time.Since(stopped); d < 150*time.Millisecond {
+		t.Errorf("consent error: expired after %v", d)
+	}
+	if err := <-doneA; err != ErrConsentExpired || managerA.Granted() {
+		t.Errorf("Run error: %v, granted %v", err, managerA.Granted())
+	}
+}
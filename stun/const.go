@@ -124,6 +124,9 @@ const (
 	errorUnassigned402                = 402
 	errorForbidden                    = 403
 	errorUnknownAttribute             = 420
+	errorStaleCredentials             = 430
+	errorIntegrityCheckFailure        = 431
+	errorMissingUsername              = 432
 	errorAllocationMismatch           = 437
 	errorStaleNonce                   = 438
 	errorUnassigned439                = 439
@@ -0,0 +1,201 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	demuxQueueSize     = 256
+	demuxMaxPacketSize = 65536
+)
+
+// DemuxConn shares a socket between STUN transactions and the application.
+// It reads the socket in the background, hands the responses of pending STUN
+// transactions to the clients using it, the STUN requests to the request
+// handler if one is set, and queues every other datagram for ReadFrom. This
+// allows keepalives and discovery to run on a socket which carries media,
+// without stealing its packets.
+//
+// Pass a DemuxConn to NewClientWithConnection or NewGatherer, and use it in
+// place of the wrapped socket.
+type DemuxConn struct {
+	conn         net.PacketConn
+	transactions *transactions
+	queue        chan datagram
+
+	mu       sync.Mutex
+	deadline time.Time
+	changed  chan struct{} // closed when the read deadline changes
+	handler  func([]byte, net.Addr) bool
+}
+
+type datagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// NewDemuxConn wraps conn, and starts reading it until it is closed.
+func NewDemuxConn(conn net.PacketConn) *DemuxConn {
+	d := &DemuxConn{
+		conn:         conn,
+		transactions: newTransactions(nil),
+		queue:        make(chan datagram, demuxQueueSize),
+		changed:      make(chan struct{}),
+	}
+	go d.read()
+	return d
+}
+
+func (d *DemuxConn) read() {
+	buf := make([]byte, demuxMaxPacketSize)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			d.transactions.fail(d.transactions.state, err)
+			return
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		if d.transactions.dispatch(b, addr) || d.handle(b, addr) {
+			continue
+		}
+		// Drop the datagram if the application does not keep up, like a
+		// full socket buffer does.
+		select {
+		case d.queue <- datagram{b, addr}:
+		default:
+		}
+	}
+}
+
+// SetRequestHandler sets the function which is given the STUN requests
+// received, and tells whether it took them. The requests it does not take
+// are queued for ReadFrom. Setting nil removes the handler.
+func (d *DemuxConn) SetRequestHandler(h func(b []byte, addr net.Addr) bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handler = h
+}
+
+// handle gives b to the request handler if it is a STUN request, and tells
+// whether the handler took it.
+func (d *DemuxConn) handle(b []byte, addr net.Addr) bool {
+	// The class of a request has both class bits cleared.
+	if len(b) < 20 || b[0]&0xc0 != 0 || binary.BigEndian.Uint16(b)&0x0110 != 0 {
+		return false
+	}
+	d.mu.Lock()
+	h := d.handler
+	d.mu.Unlock()
+	return h != nil && h(b, addr)
+}
+
+// ReadFrom reads a datagram which is not a response of a pending STUN
+// transaction, nor a request taken by the request handler.
+func (d *DemuxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		d.mu.Lock()
+		deadline, changed := d.deadline, d.changed
+		d.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			t := time.Until(deadline)
+			if t <= 0 {
+				return 0, nil, d.opError(timeoutError{})
+			}
+			timer = time.NewTimer(t)
+			expired = timer.C
+		}
+		select {
+		case p := <-d.queue:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, p.b), p.addr, nil
+		case <-d.transactions.state.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			// Return what has been queued before the error.
+			select {
+			case p := <-d.queue:
+				return copy(b, p.b), p.addr, nil
+			default:
+			}
+			return 0, nil, d.transactions.state.err
+		case <-expired:
+			return 0, nil, d.opError(timeoutError{})
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// WriteTo writes to the wrapped socket.
+func (d *DemuxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return d.conn.WriteTo(b, addr)
+}
+
+// Close closes the wrapped socket, which stops the background reading.
+func (d *DemuxConn) Close() error {
+	return d.conn.Close()
+}
+
+// LocalAddr returns the local address of the wrapped socket.
+func (d *DemuxConn) LocalAddr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines.
+func (d *DemuxConn) SetDeadline(t time.Time) error {
+	if err := d.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return d.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of ReadFrom. It does not affect the
+// background reading of the wrapped socket.
+func (d *DemuxConn) SetReadDeadline(t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadline = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the wrapped socket.
+func (d *DemuxConn) SetWriteDeadline(t time.Time) error {
+	return d.conn.SetWriteDeadline(t)
+}
+
+func (d *DemuxConn) opError(err error) error {
+	return &net.OpError{Op: "read", Net: "udp", Addr: d.conn.LocalAddr(), Err: err}
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestDemuxConn(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn, err := n.ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	peer, err := n.ListenPacket("3.0.0.2", 6000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer peer.Close()
+	d := NewDemuxConn(conn)
+	c := newTestClient(d)
+
+	// The peer sends application data while the client talks to the
+	// server on the same socket.
+	const count = 50
+	go func() {
+		for i := 0; i < count; i++ {
+			peer.WriteTo([]byte(fmt.Sprintf("media %d", i)), conn.LocalAddr())
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		host, err := c.Keepalive()
+		if err != nil {
+			t.Fatalf("Keepalive error: %v", err)
+		}
+		if host.String() != "3.0.0.1:5000" {
+			t.Errorf("Keepalive error: mapped %v", host)
+		}
+	}
+	buf := make([]byte, 100)
+	d.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < count; i++ {
+		n, addr, err := d.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom error: %v", err)
+		}
+		if string(buf[:n]) != fmt.Sprintf("media %d", i) || addr.String() != "3.0.0.2:6000" {
+			t.Errorf("ReadFrom error: %q from %v", buf[:n], addr)
+		}
+	}
+
+	// No more data: the deadline expires.
+	d.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := d.ReadFrom(buf); err == nil {
+		t.Errorf("ReadFrom error: expected timeout")
+	} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("ReadFrom error: %v, expected timeout", err)
+	}
+
+	// Closing the socket fails both the application and the client.
+	d.Close()
+	d.SetReadDeadline(time.Time{})
+	if _, _, err := d.ReadFrom(buf); err == nil {
+		t.Errorf("ReadFrom error: expected error after close")
+	}
+	if _, err := c.Keepalive(); err == nil {
+		t.Errorf("Keepalive error: expected error after close")
+	}
+}
@@ -63,16 +63,14 @@ import (
 //                                  |N
 //                                  |       Port
 //                                  +------>Restricted
-func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Host, error) {
+func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr, result *DiscoveryResult) (NATType, *Host, error) {
 	// Perform test1 to check if it is under NAT.
-	c.logger.Debugln("Do Test1")
-	c.logger.Debugln("Send To:", addr)
-	resp, err := c.test1(conn, addr)
+	resp, err := c.runTest(result, "Test I", conn, addr, false, false)
 	if err != nil {
 		return NATError, nil, err
 	}
-	c.logger.Debugln("Received:", resp)
 	if resp == nil {
+		result.Reason = "No response to Test I"
 		return NATBlocked, nil, nil
 	}
 	// identical used to check if it is open Internet or not.
@@ -97,13 +95,10 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 	}
 	// Perform test2 to see if the client can receive packet sent from
 	// another IP and port.
-	c.logger.Debugln("Do Test2")
-	c.logger.Debugln("Send To:", addr)
-	resp, err = c.test2(conn, addr)
+	resp, err = c.runTest(result, "Test II", conn, addr, true, true)
 	if err != nil {
 		return NATError, mappedAddr, err
 	}
-	c.logger.Debugln("Received:", resp)
 	// Make sure IP and port are changed.
 	if resp != nil &&
 		(resp.serverAddr.IP() == addr.IP.String() ||
@@ -112,29 +107,30 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 	}
 	if identical {
 		if resp == nil {
+			result.Reason = "Mapped address is local, but no response to Test II"
 			return SymmetricUDPFirewall, mappedAddr, nil
 		}
+		result.Reason = "Mapped address is local, and response to Test II"
 		return NATNone, mappedAddr, nil
 	}
 	if resp != nil {
+		result.Reason = "Mapped address is not local, and response to Test II"
 		return NATFull, mappedAddr, nil
 	}
 	// Perform test1 to another IP and port to see if the NAT use the same
 	// external IP.
-	c.logger.Debugln("Do Test1")
-	c.logger.Debugln("Send To:", changedAddr)
 	caddr, err := net.ResolveUDPAddr("udp", changedAddr.String())
 	if err != nil {
-		c.logger.Debugf("ResolveUDPAddr error: %v", err)
+		c.logger.Log(LevelWarn, "resolve changed address failed", "addr", changedAddr, "err", err)
 	}
-	resp, err = c.test1(conn, caddr)
+	resp, err = c.runTest(result, "Test I", conn, caddr, false, false)
 	if err != nil {
 		return NATError, mappedAddr, err
 	}
-	c.logger.Debugln("Received:", resp)
 	if resp == nil {
 		// It should be NAT_BLOCKED, but will be detected in the first
 		// step. So this will never happen.
+		result.Reason = "No response to Test I sent to the changed address"
 		return NATUnknown, mappedAddr, nil
 	}
 	// Make sure IP/port is not changed.
@@ -145,14 +141,12 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 	if mappedAddr.IP() == resp.mappedAddr.IP() && mappedAddr.Port() == resp.mappedAddr.Port() {
 		// Perform test3 to see if the client can receive packet sent
 		// from another port.
-		c.logger.Debugln("Do Test3")
-		c.logger.Debugln("Send To:", caddr)
-		resp, err = c.test3(conn, caddr)
+		resp, err = c.runTest(result, "Test III", conn, caddr, false, true)
 		if err != nil {
 			return NATError, mappedAddr, err
 		}
-		c.logger.Debugln("Received:", resp)
 		if resp == nil {
+			result.Reason = "Same mapped address for the changed address, but no response to Test III"
 			return NATPortRestricted, mappedAddr, nil
 		}
 		// Make sure IP is not changed, and port is changed.
@@ -160,8 +154,10 @@ func (c *Client) discover(conn net.PacketConn, addr *net.UDPAddr) (NATType, *Hos
 			resp.serverAddr.Port() == uint16(caddr.Port) {
 			return NATError, mappedAddr, errors.New("Server error: response IP/port")
 		}
+		result.Reason = "Same mapped address for the changed address, and response to Test III"
 		return NATRestricted, mappedAddr, nil
 	}
+	result.Reason = "Different mapped address for the changed address"
 	return NATSymmetric, mappedAddr, nil
 }
 
@@ -170,7 +166,7 @@ func (c *Client) behaviorTest(conn net.PacketConn, addr *net.UDPAddr) (*NATBehav
 
 	// Test1   ->(IP1,port1)
 	// Perform test to check if it is under NAT.
-	c.logger.Debugln("Do Test1")
+	c.logger.Log(LevelDebug, "test started", "test", "Test1")
 	resp1, err := c.test(conn, addr)
 	if err != nil {
 		return nil, err
@@ -189,10 +185,41 @@ func (c *Client) behaviorTest(conn net.PacketConn, addr *net.UDPAddr) (*NATBehav
 		}
 	}
 
+	// The filtering tests go first, since the mapping tests send packets to
+	// IP2, which opens an address dependent filter for the responses.
+
+	// Test4   ->(IP1,port1)   (IP2,port2)->
+	// Perform test to see if the client can receive packet sent from
+	// another IP and port.
+	c.logger.Log(LevelDebug, "test started", "test", "Test4")
+	resp4, err := c.testChangeBoth(conn, addr)
+	if err != nil {
+		return natBehavior, err
+	}
+	if resp4 != nil {
+		natBehavior.FilteringType = BehaviorTypeEndpoint
+	}
+
+	// Test5   ->(IP1,port1)   (IP1,port2)->
+	// Perform test to see if the client can receive packet sent from
+	// another port.
+	if natBehavior.FilteringType == BehaviorTypeUnknown {
+		c.logger.Log(LevelDebug, "test started", "test", "Test5")
+		resp5, err := c.testChangePort(conn, addr)
+		if err != nil {
+			return natBehavior, err
+		}
+		if resp5 != nil {
+			natBehavior.FilteringType = BehaviorTypeAddr
+		} else {
+			natBehavior.FilteringType = BehaviorTypeAddrAndPort
+		}
+	}
+
 	// Test2   ->(IP2,port1)
 	// Perform test to see if mapping to the same IP and port when
 	// send to another IP.
-	c.logger.Debugln("Do Test2")
+	c.logger.Log(LevelDebug, "test started", "test", "Test2")
 	tmpAddr := &net.UDPAddr{IP: net.ParseIP(otherAddr.IP()), Port: addr.Port}
 	resp2, err := c.test(conn, tmpAddr)
 	if err != nil {
@@ -207,7 +234,7 @@ func (c *Client) behaviorTest(conn net.PacketConn, addr *net.UDPAddr) (*NATBehav
 	// Perform test to see if mapping to the same IP and port when
 	// send to another port.
 	if natBehavior.MappingType == BehaviorTypeUnknown {
-		c.logger.Debugln("Do Test3")
+		c.logger.Log(LevelDebug, "test started", "test", "Test3")
 		tmpAddr.Port = int(otherAddr.Port())
 		resp3, err := c.test(conn, tmpAddr)
 		if err != nil {
@@ -221,33 +248,5 @@ func (c *Client) behaviorTest(conn net.PacketConn, addr *net.UDPAddr) (*NATBehav
 		}
 	}
 
-	// Test4   ->(IP1,port1)   (IP2,port2)->
-	// Perform test to see if the client can receive packet sent from
-	// another IP and port.
-	c.logger.Debugln("Do Test4")
-	resp4, err := c.testChangeBoth(conn, addr)
-	if err != nil {
-		return natBehavior, err
-	}
-	if resp4 != nil {
-		natBehavior.FilteringType = BehaviorTypeEndpoint
-	}
-
-	// Test5   ->(IP1,port1)   (IP1,port2)->
-	// Perform test to see if the client can receive packet sent from
-	// another port.
-	if natBehavior.FilteringType == BehaviorTypeUnknown {
-		c.logger.Debugln("Do Test5")
-		resp5, err := c.testChangePort(conn, addr)
-		if err != nil {
-			return natBehavior, err
-		}
-		if resp5 != nil {
-			natBehavior.FilteringType = BehaviorTypeAddr
-		} else {
-			natBehavior.FilteringType = BehaviorTypeAddrAndPort
-		}
-	}
-
 	return natBehavior, nil
 }
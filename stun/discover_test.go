@@ -0,0 +1,232 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+const (
+	ei  = nattest.EndpointIndependent
+	ad  = nattest.AddressDependent
+	apd = nattest.AddressAndPortDependent
+)
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *nattest.Config // nil for a host on the public network
+		nat    NATType
+		host   string
+		err    bool
+	}{
+		{"open internet", nil, NATNone, "3.0.0.1:5000", false},
+		{"firewall", &nattest.Config{Filtering: apd}, SymmetricUDPFirewall, "3.0.0.1:5000", false},
+		{"full cone", &nattest.Config{}, NATFull, "2.0.0.1:5000", false},
+		{"restricted", &nattest.Config{Filtering: ad}, NATRestricted, "2.0.0.1:5000", false},
+		{"port restricted", &nattest.Config{Filtering: apd}, NATPortRestricted, "2.0.0.1:5000", false},
+		{"address dependent mapping", &nattest.Config{Mapping: ad, Filtering: ad}, NATSymmetric, "2.0.0.1:5000", false},
+		{"symmetric", &nattest.Config{Mapping: apd, Filtering: apd, PortAllocation: nattest.PortSequential},
+			NATSymmetric, "2.0.0.1:40000", false},
+		{"blocked", &nattest.Config{LossRate: 1}, NATBlocked, "", false},
+	}
+	for _, test := range tests {
+		n := nattest.NewNetwork()
+		newTestServer(t, n)
+		var conn net.PacketConn
+		var err error
+		switch {
+		case test.config == nil:
+			conn, err = n.ListenPacket("3.0.0.1", 5000)
+		case test.nat == SymmetricUDPFirewall:
+			// A firewall is a NAT which keeps the address of the host.
+			var nat *nattest.NAT
+			nat, err = n.NewNAT("3.0.0.1", *test.config)
+			if err == nil {
+				conn, err = nat.ListenPacket("3.0.0.1", 5000)
+			}
+		default:
+			conn = listenBehindNAT(t, n, "2.0.0.1", *test.config)
+		}
+		if err != nil {
+			t.Fatalf("%s: listen error: %v", test.name, err)
+		}
+		nat, host, err := newTestClient(conn).Discover()
+		if (err != nil) != test.err {
+			t.Errorf("%s: Discover error: %v", test.name, err)
+		}
+		if nat != test.nat {
+			t.Errorf("%s: Discover error: expected %v, get %v", test.name, test.nat, nat)
+		}
+		if (host == nil && test.host != "") || (host != nil && host.String() != test.host) {
+			t.Errorf("%s: Discover error: expected host %q, get %v", test.name, test.host, host)
+		}
+	}
+}
+
+func TestDiscoverServerError(t *testing.T) {
+	for _, broken := range []string{"no other address", "ignore change"} {
+		n := nattest.NewNetwork()
+		s := newTestServer(t, n)
+		s.noOtherAddr = broken == "no other address"
+		s.ignoreChange = broken == "ignore change"
+		conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+		nat, host, err := newTestClient(conn).Discover()
+		if nat != NATError || err == nil {
+			t.Errorf("%s: Discover error: get %v, %v", broken, nat, err)
+		}
+		if host == nil || host.String() != "2.0.0.1:5000" {
+			t.Errorf("%s: Discover error: get host %v", broken, host)
+		}
+	}
+}
+
+// TestNoMappedAddress runs the tests against a server whose success
+// responses carry CHANGED-ADDRESS and OTHER-ADDRESS, but no mapped address,
+// and which ignores CHANGE-REQUEST, so that the tests go on to compare the
+// mapped addresses.
+func TestNoMappedAddress(t *testing.T) {
+	n := nattest.NewNetwork()
+	other := &net.UDPAddr{IP: net.ParseIP("1.0.0.2"), Port: 3479}
+	serve := func(server net.PacketConn) {
+		buf := make([]byte, maxPacketSize)
+		for {
+			size, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := newPacketFromBytes(buf[:size])
+			if err != nil || req.getAttribute(attributeChangeRequest) != nil {
+				continue
+			}
+			resp := &packet{types: typeBindingResponse, transID: req.transID}
+			resp.addAttribute(*newRawAddrAttribute(attributeChangedAddress, other))
+			resp.addAttribute(*newRawAddrAttribute(attributeOtherAddress, other))
+			server.WriteTo(resp.bytes(), addr)
+		}
+	}
+	for _, addr := range []string{"1.0.0.1:3478", "1.0.0.2:3478", "1.0.0.2:3479"} {
+		h := newHostFromStr(addr)
+		server, err := n.ListenPacket(h.IP(), int(h.Port()))
+		if err != nil {
+			t.Fatalf("ListenPacket error: %v", err)
+		}
+		defer server.Close()
+		go serve(server)
+	}
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+	c := newTestClient(conn)
+	if nat, host, err := c.Discover(); nat != NATError || host != nil || err == nil {
+		t.Errorf("Discover error: get %v, %v, %v", nat, host, err)
+	}
+	if _, err := c.BehaviorTest(); err == nil {
+		t.Errorf("BehaviorTest error: no error without mapped address")
+	}
+	if _, err := c.Keepalive(); err == nil {
+		t.Errorf("Keepalive error: no error without mapped address")
+	}
+}
+
+func TestBehaviorTest(t *testing.T) {
+	for _, mapping := range []nattest.Behavior{ei, ad, apd} {
+		for _, filtering := range []nattest.Behavior{ei, ad, apd} {
+			n := nattest.NewNetwork()
+			newTestServer(t, n)
+			conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{
+				Mapping:        mapping,
+				Filtering:      filtering,
+				PortAllocation: nattest.PortSequential,
+			})
+			behavior, err := newTestClient(conn).BehaviorTest()
+			if err != nil {
+				t.Fatalf("BehaviorTest error: %v", err)
+			}
+			if behavior.MappingType != BehaviorType(mapping)+1 || behavior.FilteringType != BehaviorType(filtering)+1 {
+				t.Errorf("BehaviorTest error: expected %d/%d, get %v/%v",
+					mapping, filtering, behavior.MappingType, behavior.FilteringType)
+			}
+		}
+	}
+}
+
+func TestBehaviorTestError(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn, err := n.ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	if _, err := newTestClient(conn).BehaviorTest(); err == nil {
+		t.Errorf("BehaviorTest error: no error when not behind a NAT")
+	}
+	n = nattest.NewNetwork()
+	s := newTestServer(t, n)
+	s.noOtherAddr = true
+	conn = listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+	if _, err := newTestClient(conn).BehaviorTest(); err == nil {
+		t.Errorf("BehaviorTest error: no error without other address")
+	}
+	n = nattest.NewNetwork()
+	newTestServer(t, n)
+	conn = listenBehindNAT(t, n, "2.0.0.1", nattest.Config{LossRate: 1})
+	if _, err := newTestClient(conn).BehaviorTest(); err == nil {
+		t.Errorf("BehaviorTest error: no error when blocked")
+	}
+}
+
+func TestDiscoverResult(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{Filtering: apd})
+	c := newTestClient(conn)
+	result, err := c.DiscoverResult()
+	if err != nil {
+		t.Fatalf("DiscoverResult error: %v", err)
+	}
+	if result.NAT != NATPortRestricted || result.Reason == "" {
+		t.Errorf("DiscoverResult error: get %v, %q", result.NAT, result.Reason)
+	}
+	expected := []struct {
+		name       string
+		dest       string
+		changePort bool
+		responded  bool
+	}{
+		{"Test I", "1.0.0.1:3478", false, true},
+		{"Test II", "1.0.0.1:3478", true, false},
+		{"Test I", "1.0.0.2:3479", false, true},
+		{"Test III", "1.0.0.2:3479", true, false},
+	}
+	if len(result.Tests) != len(expected) {
+		t.Fatalf("DiscoverResult error: get %d tests", len(result.Tests))
+	}
+	for i, e := range expected {
+		test := result.Tests[i]
+		if test.Name != e.name || test.Dest.String() != e.dest ||
+			test.ChangePort != e.changePort || test.Responded != e.responded {
+			t.Errorf("DiscoverResult error: test %d is %+v", i, test)
+		}
+		if test.Responded && (test.Attempts != 1 || test.MappedAddr.String() != "2.0.0.1:5000" ||
+			test.ServerAddr.String() != e.dest || test.OtherAddr == nil) {
+			t.Errorf("DiscoverResult error: test %d is %+v", i, test)
+		}
+		if !test.Responded && test.Attempts != c.numRetransmit {
+			t.Errorf("DiscoverResult error: test %d has %d attempts", i, test.Attempts)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+// The seed corpus is in testdata/fuzz. Run the fuzzers with, for example,
+// go test -fuzz=FuzzDecode ./stun
+
+// FuzzDecode checks that decoding never panics, and that a decoded message
+// is encoded to the same attributes.
+func FuzzDecode(f *testing.F) {
+	f.Fuzz(func(t *testing.T, b []byte) {
+		pkt, err := newPacketFromBytes(b)
+		if err != nil {
+			return
+		}
+		pkt.getXorMappedAddr()
+		pkt.getMappedAddr()
+		pkt.getChangedAddr()
+		pkt.getOtherAddr()
+		pkt.getSourceAddr()
+		pkt.getErrorCode()
+		pkt.checkFingerprint()
+		pkt.checkIntegrity([]byte("key"))
+		again, err := newPacketFromBytes(pkt.bytes())
+		if err != nil {
+			t.Fatalf("decoding the encoded message: %v", err)
+		}
+		if again.types != pkt.types || !bytes.Equal(again.transID, pkt.transID) ||
+			len(again.attributes) != len(pkt.attributes) {
+			t.Fatalf("encoded message differs")
+		}
+		for i, a := range pkt.attributes {
+			if b := again.attributes[i]; b.types != a.types || !bytes.Equal(b.value, a.value) {
+				t.Fatalf("attribute %d differs", i)
+			}
+		}
+	})
+}
+
+// FuzzServer checks that the server answers any request without panicking.
+func FuzzServer(f *testing.F) {
+	n := nattest.NewNetwork()
+	var conns [2][2]net.PacketConn
+	for i, ip := range []string{"1.0.0.1", "1.0.0.2"} {
+		for j, port := range []int{3478, 3479} {
+			conn, err := n.ListenPacket(ip, port)
+			if err != nil {
+				f.Fatalf("ListenPacket error: %v", err)
+			}
+			defer conn.Close()
+			conns[i][j] = conn
+		}
+	}
+	s := NewServer(conns)
+	from := &net.UDPAddr{IP: net.ParseIP("3.0.0.1"), Port: 5000}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, err := newPacketFromBytes(b)
+		if err != nil || req.types != typeBindingRequest {
+			return
+		}
+		resp := new(packet)
+		s.handle(req, resp, from, 0, 0)
+		if _, err := newPacketFromBytes(resp.bytes()); err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+	})
+}
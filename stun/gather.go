@@ -0,0 +1,183 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"errors"
+	"net"
+)
+
+// Gatherer collects ICE candidates of a connection and reports each of them
+// as soon as it is found, which allows trickle ICE signalling.
+type Gatherer struct {
+	client    *Client
+	conn      net.PacketConn
+	servers   []string
+	component int
+	handler   func(*Candidate)
+}
+
+// NewGatherer returns a gatherer for the given connection, which should be
+// acquired via net.Listen* method. Server reflexive candidates are learned
+// from each of the given STUN servers in order.
+func NewGatherer(conn net.PacketConn, servers ...string) *Gatherer {
+	g := new(Gatherer)
+	g.client = NewClientWithConnection(conn)
+	g.conn = conn
+	g.servers = servers
+	g.component = 1
+	return g
+}
+
+// Client returns the STUN client used by the gatherer, which allows setting
+// the verbose modes and the software name.
+func (g *Gatherer) Client() *Client {
+	return g.client
+}
+
+// SetComponent sets the ICE component ID of the candidates, 1 by default.
+func (g *Gatherer) SetComponent(id int) {
+	g.component = id
+}
+
+// SetCandidateHandler sets the function called for every gathered candidate.
+// When gathering completes, the handler is called with a nil candidate,
+// which corresponds to the end-of-candidates indication.
+func (g *Gatherer) SetCandidateHandler(h func(*Candidate)) {
+	g.handler = h
+}
+
+// Gather reports the host candidates of every usable interface first, then
+// the server reflexive candidate obtained from each STUN server. A server
+// that cannot be reached is skipped. Candidates which are identical to one
+// already reported are not reported again.
+func (g *Gatherer) Gather() error {
+	localAddr, err := net.ResolveUDPAddr("udp", g.conn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	hostIPs, err := gatherHostIPs(localAddr.IP)
+	if err != nil {
+		return err
+	}
+	var gathered []*Candidate
+	emit := func(c *Candidate) {
+		for _, o := range gathered {
+			if o.Addr.String() == c.Addr.String() {
+				g.client.logger.Log(LevelDebug, "redundant candidate", "candidate", c)
+				return
+			}
+		}
+		gathered = append(gathered, c)
+		if g.handler != nil {
+			g.handler(c)
+		}
+	}
+	for i, ip := range hostIPs {
+		addr := newHostFromUDPAddr(&net.UDPAddr{IP: ip, Port: localAddr.Port})
+		emit(newCandidate(CandidateHost, addr, nil, "", g.component, uint32(65535-i)))
+	}
+	for _, server := range g.servers {
+		serverUDPAddr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			g.client.logger.Log(LevelWarn, "resolve server address failed", "server", server, "err", err)
+			continue
+		}
+		resp, err := g.client.test1(g.conn, serverUDPAddr)
+		if err != nil || resp == nil || resp.mappedAddr == nil {
+			g.client.logger.Log(LevelDebug, "no server reflexive candidate", "server", server, "err", err)
+			continue
+		}
+		emit(newCandidate(CandidateServerReflexive, resp.mappedAddr,
+			candidateBase(gathered, serverUDPAddr, localAddr), server, g.component, 65535))
+	}
+	if g.handler != nil {
+		g.handler(nil)
+	}
+	return nil
+}
+
+// candidateBase returns the host candidate which a server reflexive
+// candidate learned from server is based on, as RFC 8445 section 5.1.1.2
+// requires, and which is its related address. A socket bound to the wildcard
+// address sends from the address of the route to server, or else from one of
+// the family of server.
+func candidateBase(gathered []*Candidate, server, localAddr *net.UDPAddr) *Host {
+	if !localAddr.IP.IsUnspecified() {
+		return newHostFromUDPAddr(localAddr)
+	}
+	var route string
+	if conn, err := net.DialUDP("udp", nil, server); err == nil {
+		route = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+	}
+	family := uint16(attributeFamilyIPv4)
+	if server.IP.To4() == nil {
+		family = attributeFamilyIPV6
+	}
+	var base *Host
+	for _, c := range gathered {
+		if c.Type != CandidateHost || c.Addr.Family() != family {
+			continue
+		}
+		if c.Addr.IP() == route {
+			return c.Addr
+		}
+		if base == nil {
+			base = c.Addr
+		}
+	}
+	if base == nil {
+		return newHostFromUDPAddr(localAddr)
+	}
+	return base
+}
+
+// gatherHostIPs returns ip itself if it is specified, otherwise the addresses
+// of all interfaces that are up, excluding loopback and link-local ones.
+func gatherHostIPs(ip net.IP) ([]net.IP, error) {
+	if ip != nil && !ip.IsUnspecified() {
+		return []net.IP{ip}, nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			// An IPv4 socket cannot use IPv6 addresses.
+			if ip != nil && ip.To4() != nil && ipnet.IP.To4() == nil {
+				continue
+			}
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no usable interface address")
+	}
+	return ips, nil
+}
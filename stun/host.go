@@ -15,6 +15,7 @@
 package stun
 
 import (
+	"errors"
 	"net"
 	"strconv"
 )
@@ -31,6 +32,10 @@ func newHostFromStr(s string) *Host {
 	if err != nil {
 		return nil
 	}
+	return newHostFromUDPAddr(udpAddr)
+}
+
+func newHostFromUDPAddr(udpAddr *net.UDPAddr) *Host {
 	host := new(Host)
 	if udpAddr.IP.To4() != nil {
 		host.family = attributeFamilyIPv4
@@ -66,3 +71,18 @@ func (h *Host) TransportAddr() string {
 func (h *Host) String() string {
 	return h.TransportAddr()
 }
+
+// MarshalText encodes the host as its transport layer address.
+func (h *Host) MarshalText() ([]byte, error) {
+	return []byte(h.TransportAddr()), nil
+}
+
+// UnmarshalText decodes a transport layer address encoded by MarshalText.
+func (h *Host) UnmarshalText(b []byte) error {
+	host := newHostFromStr(string(b))
+	if host == nil {
+		return errors.New("invalid host address: " + string(b))
+	}
+	*h = *host
+	return nil
+}
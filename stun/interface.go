@@ -0,0 +1,90 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"errors"
+	"net"
+)
+
+// InterfaceResult is the result of discovery from an address of a network
+// interface.
+type InterfaceResult struct {
+	Interface string
+	LocalIP   string
+	Result    *DiscoveryResult // never nil
+	Err       error
+}
+
+// DiscoverPerInterface runs the discover process from every usable address
+// of every network interface which is up, which tells the NAT type and the
+// mapped address of each uplink of a multi-homed host. Addresses which are
+// not of the family of the server address are skipped, and so are loopback
+// and link-local ones. The local port set is used for all of them.
+func (c *Client) DiscoverPerInterface() ([]InterfaceResult, error) {
+	serverUDPAddr, err := c.resolveServer()
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := c.interfaceAddrs(serverUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no usable interface address")
+	}
+	var results []InterfaceResult
+	for _, a := range addrs {
+		r := InterfaceResult{Interface: a.Name, LocalIP: a.Net.IP.String()}
+		c.logger.Log(LevelInfo, "interface discovery", "interface", a.Name, "ip", a.Net.IP)
+		conn, err := c.listen(&net.UDPAddr{IP: a.Net.IP, Port: c.localPort})
+		if err != nil {
+			r.Result, r.Err = &DiscoveryResult{NAT: NATError}, err
+		} else {
+			r.Result, r.Err = c.discoverResult(conn, serverUDPAddr)
+			conn.Close()
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// interfaceAddrs returns the usable addresses of the interfaces, of the
+// family of server.
+func (c *Client) interfaceAddrs(server *net.UDPAddr) ([]InterfaceAddr, error) {
+	list, err := c.interfaces.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []InterfaceAddr
+	for _, a := range list {
+		if a.Net == nil {
+			continue
+		}
+		ip := a.Net.IP
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ip.To4() != nil) != (server.IP.To4() != nil) {
+			continue
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+func listenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
+	return net.ListenUDP("udp", laddr)
+}
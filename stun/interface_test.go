@@ -0,0 +1,88 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+// newMultihomedClient returns a client on a host with a wired uplink behind
+// a full cone NAT and a wireless one behind a symmetric NAT.
+func newMultihomedClient(t *testing.T) *Client {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	wired, err := n.NewNAT("2.0.0.1", nattest.Config{})
+	if err != nil {
+		t.Fatalf("NewNAT error: %v", err)
+	}
+	wireless, err := n.NewNAT("2.0.0.2", nattest.Config{Mapping: apd, Filtering: apd})
+	if err != nil {
+		t.Fatalf("NewNAT error: %v", err)
+	}
+	c := newTestClient(nil)
+	c.interfaces = &fakeInterfaces{addrs: []string{
+		"lo 127.0.0.1/8", "eth0 10.0.0.2/24", "eth0 fe80::1/64", "wlan0 10.1.0.2/24",
+	}}
+	c.listen = func(laddr *net.UDPAddr) (net.PacketConn, error) {
+		if laddr.IP.Equal(net.ParseIP("10.0.0.2")) {
+			return wired.ListenPacket("10.0.0.2", 5000)
+		}
+		return wireless.ListenPacket(laddr.IP.String(), 5000)
+	}
+	return c
+}
+
+func TestDiscoverPerInterface(t *testing.T) {
+	c := newMultihomedClient(t)
+	results, err := c.DiscoverPerInterface()
+	if err != nil {
+		t.Fatalf("DiscoverPerInterface error: %v", err)
+	}
+	expected := []struct {
+		iface, ip string
+		nat       NATType
+		host      string
+	}{
+		{"eth0", "10.0.0.2", NATFull, "2.0.0.1:5000"},
+		{"wlan0", "10.1.0.2", NATSymmetric, "2.0.0.2:5000"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("DiscoverPerInterface error: %d results, expected %d", len(results), len(expected))
+	}
+	for i, r := range results {
+		v := expected[i]
+		if r.Interface != v.iface || r.LocalIP != v.ip || r.Err != nil ||
+			r.Result.NAT != v.nat || r.Result.Host.String() != v.host {
+			t.Errorf("DiscoverPerInterface error: %s %s %v %v %v", r.Interface, r.LocalIP,
+				r.Result.NAT, r.Result.Host, r.Err)
+		}
+	}
+}
+
+func TestSetInterface(t *testing.T) {
+	c := newMultihomedClient(t)
+	c.SetInterface("wlan0")
+	nat, host, err := c.Discover()
+	if err != nil || nat != NATSymmetric || host.String() != "2.0.0.2:5000" {
+		t.Errorf("Discover error: %v %v %v", nat, host, err)
+	}
+	c.SetInterface("ppp0")
+	if _, _, err := c.Discover(); err == nil {
+		t.Errorf("Discover error: expected error for unknown interface")
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultKeepaliveInterval is the keepalive interval unless set otherwise.
+// RFC 4787 requires NATs to keep idle UDP bindings for at least 2 minutes,
+// but many expire them after 30 seconds.
+const DefaultKeepaliveInterval = 15 * time.Second
+
+// minKeepaliveInterval is the shortest keepalive interval, which keeps a
+// misconfigured manager from flooding the server.
+const minKeepaliveInterval = time.Second
+
+// bindingLifetimeResolution is the precision of MeasureBindingLifetime.
+const bindingLifetimeResolution = time.Second
+
+// KeepaliveEventType is the type of a keepalive event.
+type KeepaliveEventType int
+
+// Keepalive event types.
+const (
+	// KeepaliveMappingChanged means a new mapped address is learned,
+	// including the first one.
+	KeepaliveMappingChanged KeepaliveEventType = iota
+	// KeepaliveServerLost means the server stops answering.
+	KeepaliveServerLost
+	// KeepaliveServerRecovered means the server answers again.
+	KeepaliveServerRecovered
+)
+
+var keepaliveEventTypeStr = map[KeepaliveEventType]string{
+	KeepaliveMappingChanged:  "mapping changed",
+	KeepaliveServerLost:      "server lost",
+	KeepaliveServerRecovered: "server recovered",
+}
+
+func (t KeepaliveEventType) String() string {
+	return keepaliveEventTypeStr[t]
+}
+
+// KeepaliveEvent is a change observed by the keepalive manager.
+type KeepaliveEvent struct {
+	Type     KeepaliveEventType
+	Time     time.Time
+	Mapped   *Host // current mapped address, nil if the server is lost
+	Previous *Host // previous mapped address, for KeepaliveMappingChanged
+	Err      error // why the server is considered lost
+}
+
+// KeepaliveManager keeps the mapping of a client's connection open by
+// sending Binding requests periodically, and reports when the mapping
+// changes, which happens when the NAT rebinds, and when the server is lost or
+// recovers.
+type KeepaliveManager struct {
+	client   *Client
+	interval time.Duration
+	events   chan KeepaliveEvent
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+// NewKeepaliveManager returns a keepalive manager of the client, which must
+// have been created by NewClientWithConnection.
+func NewKeepaliveManager(c *Client) *KeepaliveManager {
+	m := new(KeepaliveManager)
+	m.client = c
+	m.interval = DefaultKeepaliveInterval
+	m.events = make(chan KeepaliveEvent, 16)
+	m.sleep = sleepContext
+	return m
+}
+
+// SetInterval sets the time between two Binding requests, which is at least
+// a second.
+func (m *KeepaliveManager) SetInterval(d time.Duration) {
+	if d < minKeepaliveInterval {
+		d = minKeepaliveInterval
+	}
+	m.interval = d
+}
+
+// SetBindingLifetime sets the interval to half of the lifetime of idle
+// bindings of the NAT, which may be measured by MeasureBindingLifetime.
+func (m *KeepaliveManager) SetBindingLifetime(d time.Duration) {
+	m.SetInterval(d / 2)
+}
+
+// Events returns the channel of events. It is closed when Run returns. The
+// keepalive stalls if the events are not received.
+func (m *KeepaliveManager) Events() <-chan KeepaliveEvent {
+	return m.events
+}
+
+// Run sends Binding requests until ctx is done, and returns the error of
+// ctx, even while a request is pending. It can only be called once.
+func (m *KeepaliveManager) Run(ctx context.Context) error {
+	defer close(m.events)
+	var mapped *Host
+	lost := false
+	for {
+		host, err := m.client.keepalive(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var events []KeepaliveEvent
+		switch {
+		case err != nil && !lost:
+			lost = true
+			events = append(events, KeepaliveEvent{Type: KeepaliveServerLost, Err: err})
+		case err == nil:
+			if lost {
+				lost = false
+				events = append(events, KeepaliveEvent{Type: KeepaliveServerRecovered, Mapped: host})
+			}
+			if mapped == nil || mapped.String() != host.String() {
+				events = append(events, KeepaliveEvent{Type: KeepaliveMappingChanged,
+					Mapped: host, Previous: mapped})
+				mapped = host
+			}
+		}
+		for _, e := range events {
+			e.Time = time.Now()
+			m.client.logger.Log(LevelInfo, "keepalive", "event", e.Type, "mapped", e.Mapped,
+				"previous", e.Previous, "err", e.Err)
+			select {
+			case m.events <- e:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err := m.sleep(ctx, m.interval); err != nil {
+			return err
+		}
+	}
+}
+
+// MeasureBindingLifetime finds how long the NAT keeps an idle binding of the
+// client's connection, up to max, by the method of RFC 5780 section 4.6. It
+// refreshes the binding, waits, and then asks the server through probe to
+// answer to the binding with the RESPONSE-PORT attribute. The binding is
+// alive if the answer arrives. The waiting time is found by binary search,
+// so the measurement takes several times max.
+//
+// The probe must be another socket behind the same NAT, and the server must
+// support RESPONSE-PORT. The connection must not be used meanwhile.
+func (m *KeepaliveManager) MeasureBindingLifetime(ctx context.Context, probe net.PacketConn, max time.Duration) (time.Duration, error) {
+	alive, err := m.bindingAlive(ctx, probe, max)
+	if err != nil || alive {
+		return max, err
+	}
+	// A binding which is not idle at all is alive, unless the server does
+	// not support RESPONSE-PORT.
+	if alive, err = m.bindingAlive(ctx, probe, 0); err != nil {
+		return 0, err
+	}
+	if !alive {
+		return 0, errors.New("Server error: no response to RESPONSE-PORT")
+	}
+	lo, hi := time.Duration(0), max
+	for hi-lo > bindingLifetimeResolution {
+		mid := lo + (hi-lo)/2
+		alive, err := m.bindingAlive(ctx, probe, mid)
+		if err != nil {
+			return 0, err
+		}
+		if alive {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	m.client.logger.Log(LevelInfo, "binding lifetime", "lifetime", lo)
+	return lo, nil
+}
+
+// bindingAlive tells whether the binding of the client's connection is still
+// alive after being idle for d.
+func (m *KeepaliveManager) bindingAlive(ctx context.Context, probe net.PacketConn, d time.Duration) (bool, error) {
+	c := m.client
+	mapped, err := c.keepalive(ctx)
+	if err != nil {
+		return false, err
+	}
+	if err := m.sleep(ctx, d); err != nil {
+		return false, err
+	}
+	serverUDPAddr, err := c.resolveServer()
+	if err != nil {
+		return false, err
+	}
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint16(value, mapped.Port())
+	pkt, err := c.newBindingReq(false, false, *newAttribute(attributeResponsePort, value))
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.exchange(pkt, probe, c.conn, serverUDPAddr)
+	if err != nil {
+		return false, err
+	}
+	m.client.logger.Log(LevelDebug, "binding probe", "idle", d, "alive", resp != nil)
+	return resp != nil, nil
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+// fakeClock is the clock of a virtual network, which only moves forward when
+// told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return ctx.Err()
+}
+
+func TestKeepaliveManager(t *testing.T) {
+	n := nattest.NewNetwork()
+	s := newTestServer(t, n)
+	nat, err := n.NewNAT("2.0.0.1", nattest.Config{PortAllocation: nattest.PortSequential})
+	if err != nil {
+		t.Fatalf("NewNAT error: %v", err)
+	}
+	conn, err := nat.ListenPacket("10.0.0.2", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+
+	m := NewKeepaliveManager(newTestClient(conn))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Each interval, change the network: the NAT reboots, the server goes
+	// down, the server comes back.
+	round := 0
+	m.sleep = func(ctx context.Context, d time.Duration) error {
+		round++
+		switch round {
+		case 1:
+			nat.Flush()
+		case 2:
+			atomic.StoreInt32(&s.silent, 1)
+		case 3:
+			atomic.StoreInt32(&s.silent, 0)
+		case 4:
+			cancel()
+		}
+		return ctx.Err()
+	}
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	expected := []struct {
+		typ      KeepaliveEventType
+		mapped   string
+		previous string
+	}{
+		{KeepaliveMappingChanged, "2.0.0.1:40000", ""},
+		{KeepaliveMappingChanged, "2.0.0.1:40001", "2.0.0.1:40000"},
+		{KeepaliveServerLost, "", ""},
+		{KeepaliveServerRecovered, "2.0.0.1:40001", ""},
+	}
+	var events []KeepaliveEvent
+	for e := range m.Events() {
+		events = append(events, e)
+	}
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run error: %v", err)
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Keepalive error: %d events, expected %d", len(events), len(expected))
+	}
+	for i, e := range events {
+		v := expected[i]
+		if e.Type != v.typ || hostStr(e.Mapped) != v.mapped || hostStr(e.Previous) != v.previous {
+			t.Errorf("Keepalive event %d error: %v %v %v", i, e.Type, e.Mapped, e.Previous)
+		}
+	}
+	if events[2].Err == nil {
+		t.Errorf("Keepalive error: server lost without error")
+	}
+}
+
+func TestKeepaliveCancel(t *testing.T) {
+	n := nattest.NewNetwork()
+	s := newTestServer(t, n)
+	atomic.StoreInt32(&s.silent, 1)
+	conn, err := n.ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+	// The default retransmissions against the silent server take seconds.
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(testServerAddr)
+	m := NewKeepaliveManager(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Run error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run error: not returned after cancel")
+	}
+	// The cancelled request does not lose the server.
+	for e := range m.Events() {
+		t.Errorf("Keepalive error: event %v", e.Type)
+	}
+}
+
+func TestKeepaliveInterval(t *testing.T) {
+	m := NewKeepaliveManager(NewClient())
+	for _, d := range []time.Duration{0, -time.Second, time.Millisecond} {
+		if m.SetInterval(d); m.interval != minKeepaliveInterval {
+			t.Errorf("SetInterval(%v) error: interval %v", d, m.interval)
+		}
+		if m.SetBindingLifetime(d); m.interval != minKeepaliveInterval {
+			t.Errorf("SetBindingLifetime(%v) error: interval %v", d, m.interval)
+		}
+	}
+	if m.SetBindingLifetime(time.Minute); m.interval != 30*time.Second {
+		t.Errorf("SetBindingLifetime error: interval %v", m.interval)
+	}
+}
+
+func TestMeasureBindingLifetime(t *testing.T) {
+	n := nattest.NewNetwork()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	n.SetClock(clock.Now)
+	newTestServer(t, n)
+	nat, err := n.NewNAT("2.0.0.1", nattest.Config{Filtering: apd, BindingTimeout: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("NewNAT error: %v", err)
+	}
+	conn, err := nat.ListenPacket("10.0.0.2", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+	probe, err := nat.ListenPacket("10.0.0.2", 5001)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer probe.Close()
+
+	m := NewKeepaliveManager(newTestClient(conn))
+	m.sleep = clock.sleep
+	d, err := m.MeasureBindingLifetime(context.Background(), probe, 2*time.Minute)
+	if err != nil {
+		t.Fatalf("MeasureBindingLifetime error: %v", err)
+	}
+	if d < 29*time.Second || d >= 30*time.Second {
+		t.Errorf("MeasureBindingLifetime error: %v, expected 30s", d)
+	}
+}
+
+func hostStr(h *Host) string {
+	if h == nil {
+		return ""
+	}
+	return h.String()
+}
@@ -0,0 +1,243 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// CandidatePair is a pair of a local and a remote candidate, which ICE
+// checks connectivity of.
+type CandidatePair struct {
+	Local  *Candidate
+	Remote *Candidate
+}
+
+// LiteAgent is an ICE-lite agent as in RFC 8445 section 2.5, for a host with
+// a public address. It never sends connectivity checks, but answers the
+// ones of the full agent on the peer, which is always controlling, and
+// learns the addresses of the peer from them.
+type LiteAgent struct {
+	conn      net.PacketConn
+	ufrag     string
+	key       []byte // pwd, the key of MESSAGE-INTEGRITY
+	component int
+
+	mu              sync.Mutex
+	remote          []*Candidate
+	addrs           []*net.UDPAddr // of remote, nil if not an IP address
+	selected        *CandidatePair
+	reflexive       func(*Candidate)
+	selectedHandler func(*CandidatePair)
+}
+
+// NewLiteAgent returns an ICE-lite agent of the media socket conn, whose
+// local credentials are ufrag and pwd.
+func NewLiteAgent(conn net.PacketConn, ufrag, pwd string) *LiteAgent {
+	a := new(LiteAgent)
+	a.conn = conn
+	a.ufrag = ufrag
+	a.key = []byte(pwd)
+	a.component = 1
+	return a
+}
+
+// SetComponent sets the ICE component ID of the socket, 1 by default.
+func (a *LiteAgent) SetComponent(id int) {
+	a.component = id
+}
+
+// SetPeerReflexiveHandler sets the function called for every peer reflexive
+// candidate, which is the source of a check not among the remote candidates.
+func (a *LiteAgent) SetPeerReflexiveHandler(h func(*Candidate)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reflexive = h
+}
+
+// SetSelectedHandler sets the function called when the peer nominates a
+// pair by USE-CANDIDATE, which is the pair to send media on.
+func (a *LiteAgent) SetSelectedHandler(h func(*CandidatePair)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.selectedHandler = h
+}
+
+// AddRemoteCandidate adds a candidate signalled by the peer.
+func (a *LiteAgent) AddRemoteCandidate(c *Candidate) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.remote = append(a.remote, c)
+	addr, err := net.ResolveUDPAddr("udp", c.Addr.TransportAddr())
+	if err != nil || addr.IP == nil {
+		addr = nil
+	}
+	a.addrs = append(a.addrs, addr)
+}
+
+// RemoteCandidates returns the candidates signalled by the peer and the
+// peer reflexive ones learned so far.
+func (a *LiteAgent) RemoteCandidates() []*Candidate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Candidate(nil), a.remote...)
+}
+
+// Selected returns the pair nominated by the peer, or nil if none is yet.
+func (a *LiteAgent) Selected() *CandidatePair {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.selected
+}
+
+// Serve answers the checks on the socket until it is closed. Datagrams
+// other than STUN messages are dropped, so Serve is only for a socket which
+// carries no media; otherwise pass the received datagrams to Handle.
+func (a *LiteAgent) Serve() error {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		a.Handle(buf[:n], addr)
+	}
+}
+
+// Handle answers b received from addr if it is a connectivity check, and
+// tells whether b is a STUN message, which the application should not
+// process as media. Invalid checks are answered with an error, or dropped if
+// they fail FINGERPRINT. Answering a check does not allocate, unless it
+// teaches a peer reflexive candidate or nominates a new pair.
+func (a *LiteAgent) Handle(b []byte, addr net.Addr) bool {
+	req := packetPool.Get().(*packet)
+	defer packetPool.Put(req)
+	if err := req.decode(b); err != nil {
+		return false
+	}
+	from, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if from, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+			return true
+		}
+	}
+	if req.types != typeBindingRequest || !req.checkFingerprint() {
+		return true
+	}
+	resp := packetPool.Get().(*packet)
+	defer packetPool.Put(resp)
+	nominated := a.check(req, resp, from)
+	// The handlers run before the response is sent, so that the
+	// application knows the pair when the peer starts sending media.
+	if nominated != nil {
+		a.mu.Lock()
+		h := a.selectedHandler
+		a.mu.Unlock()
+		if h != nil {
+			h(nominated)
+		}
+	}
+	resp.addFingerprint()
+	writePacket(a.conn, resp, from)
+	return true
+}
+
+// check builds in resp the response to the check req from from, without
+// FINGERPRINT, and returns the pair it nominates, if it does and the pair
+// was not selected before.
+func (a *LiteAgent) check(req, resp *packet, from *net.UDPAddr) *CandidatePair {
+	username := req.getAttribute(attributeUsername)
+	priority := req.getAttribute(attributePriority)
+	if username == nil || req.getAttribute(attributeMessageIntegrity) == nil ||
+		priority == nil || len(priority.value) != 4 {
+		resp.respondError(req, errorBadRequest, errorReasons[errorBadRequest])
+		return nil
+	}
+	// RFC 8445: the USERNAME of a check is the ufrag of the receiver,
+	// a colon and the ufrag of the sender.
+	name := username.value
+	if len(name) <= len(a.ufrag) || string(name[:len(a.ufrag)]) != a.ufrag || name[len(a.ufrag)] != ':' ||
+		!req.checkIntegrity(a.key) {
+		resp.respondError(req, errorUnauthorized, errorReasons[errorUnauthorized])
+		return nil
+	}
+	var nominated *CandidatePair
+	if req.getAttribute(attributeIceControlled) != nil {
+		// A lite agent is always controlled, so the peer must take
+		// the controlling role.
+		resp.respondError(req, errorRoleConflict, errorReasons[errorRoleConflict])
+	} else {
+		resp.respond(req, typeBindingResponse)
+		resp.addXorAddr(attributeXorMappedAddress, from)
+		remote := a.learn(from, binary.BigEndian.Uint32(priority.value))
+		if req.getAttribute(attributeUseCandidate) != nil {
+			nominated = a.nominate(remote)
+		}
+	}
+	resp.addIntegrity(a.key)
+	return nominated
+}
+
+// learn returns the remote candidate of addr, which is a new peer reflexive
+// candidate if the peer has not signalled it.
+func (a *LiteAgent) learn(addr *net.UDPAddr, priority uint32) *Candidate {
+	a.mu.Lock()
+	for i, c := range a.remote {
+		if known := a.addrs[i]; c.Component == a.component && known != nil &&
+			known.Port == addr.Port && known.IP.Equal(addr.IP) {
+			a.mu.Unlock()
+			return c
+		}
+	}
+	// RFC 8445 section 7.3.1.3: the priority of a peer reflexive
+	// candidate is the PRIORITY of the check, and its foundation is an
+	// arbitrary unique value.
+	c := &Candidate{
+		Foundation: "prflx" + strconv.Itoa(len(a.remote)),
+		Component:  a.component,
+		Protocol:   "udp",
+		Priority:   priority,
+		Addr:       newHostFromUDPAddr(addr),
+		Type:       CandidatePeerReflexive,
+	}
+	a.remote = append(a.remote, c)
+	a.addrs = append(a.addrs, &net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port})
+	h := a.reflexive
+	a.mu.Unlock()
+	if h != nil {
+		h(c)
+	}
+	return c
+}
+
+// nominate selects the pair of remote, and returns it unless it is selected
+// already.
+func (a *LiteAgent) nominate(remote *Candidate) *CandidatePair {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.selected != nil && a.selected.Remote == remote {
+		return nil
+	}
+	local := newHostFromStr(a.conn.LocalAddr().String())
+	a.selected = &CandidatePair{
+		Local:  newCandidate(CandidateHost, local, nil, "", a.component, 65535),
+		Remote: remote,
+	}
+	return a.selected
+}
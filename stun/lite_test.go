@@ -0,0 +1,189 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestLiteAgent(t *testing.T) {
+	n := nattest.NewNetwork()
+	conn, err := n.ListenPacket("1.0.0.1", 3478)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+	agent := NewLiteAgent(conn, "lite", "litepassword")
+	signalled, _ := ParseCandidate("candidate:1 1 udp 2130706431 3.0.0.1 5000 typ host")
+	agent.AddRemoteCandidate(signalled)
+	var reflexive []*Candidate
+	var selected []*CandidatePair
+	agent.SetPeerReflexiveHandler(func(c *Candidate) { reflexive = append(reflexive, c) })
+	agent.SetSelectedHandler(func(p *CandidatePair) { selected = append(selected, p) })
+	go agent.Serve()
+
+	direct, err := n.ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer direct.Close()
+	// The peer is also reachable behind a NAT, at an address it does not
+	// know and has not signalled.
+	natted := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+	defer natted.Close()
+
+	type check struct {
+		username string
+		password string
+		priority bool
+		role     uint16
+		nominate bool
+	}
+	send := func(conn net.PacketConn, c check) *packet {
+		pkt, err := newPacket()
+		if err != nil {
+			t.Fatalf("newPacket error: %v", err)
+		}
+		pkt.types = typeBindingRequest
+		if c.username != "" {
+			pkt.addAttribute(*newUsernameAttribute(c.username))
+		}
+		if c.priority {
+			pkt.addAttribute(*newAttribute(attributePriority, []byte{0x6e, 0, 1, 0xff}))
+		}
+		pkt.addAttribute(*newAttribute(c.role, make([]byte, 8)))
+		if c.nominate {
+			pkt.addAttribute(*newUseCandidateAttribute())
+		}
+		pkt.addIntegrity([]byte(c.password))
+		pkt.addFingerprint()
+		if _, err := conn.WriteTo(pkt.bytes(), &net.UDPAddr{IP: net.ParseIP("1.0.0.1"), Port: 3478}); err != nil {
+			t.Fatalf("WriteTo error: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, maxPacketSize)
+		size, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom error: %v", err)
+		}
+		resp, err := newPacketFromBytes(buf[:size])
+		if err != nil || string(resp.transID) != string(pkt.transID) || !resp.checkFingerprint() {
+			t.Fatalf("invalid response: %v", err)
+		}
+		return resp
+	}
+
+	valid := check{"lite:full", "litepassword", true, attributeIceControlling, false}
+	for _, test := range []struct {
+		name  string
+		check check
+		code  int
+	}{
+		{"no username", check{"", "litepassword", true, attributeIceControlling, false}, errorBadRequest},
+		{"no priority", check{"lite:full", "litepassword", false, attributeIceControlling, false}, errorBadRequest},
+		{"wrong ufrag", check{"other:full", "litepassword", true, attributeIceControlling, false}, errorUnauthorized},
+		{"wrong password", check{"lite:full", "wrong", true, attributeIceControlling, false}, errorUnauthorized},
+		{"controlled peer", check{"lite:full", "litepassword", true, attributeIceControlled, false}, errorRoleConflict},
+	} {
+		resp := send(direct, test.check)
+		if code, _ := resp.getErrorCode(); resp.types != typeBindingErrorResponse || code != test.code {
+			t.Errorf("%s: response 0x%04x %d, want %d", test.name, resp.types, code, test.code)
+		}
+	}
+
+	resp := send(direct, valid)
+	if h := resp.getXorMappedAddr(); resp.types != typeBindingResponse || h == nil || h.String() != "3.0.0.1:5000" {
+		t.Errorf("response 0x%04x, XOR-MAPPED-ADDRESS %v", resp.types, h)
+	}
+	if !resp.checkIntegrity([]byte("litepassword")) {
+		t.Errorf("invalid MESSAGE-INTEGRITY")
+	}
+	if len(reflexive) != 0 || len(selected) != 0 {
+		t.Errorf("signalled candidate learned as peer reflexive")
+	}
+
+	valid.nominate = true
+	resp = send(natted, valid)
+	if h := resp.getXorMappedAddr(); h == nil || h.IP() != "2.0.0.1" {
+		t.Fatalf("XOR-MAPPED-ADDRESS %v", h)
+	}
+	mapped := resp.getXorMappedAddr().String()
+	if len(reflexive) != 1 || reflexive[0].Addr.String() != mapped ||
+		reflexive[0].Type != CandidatePeerReflexive || reflexive[0].Priority != binary.BigEndian.Uint32([]byte{0x6e, 0, 1, 0xff}) {
+		t.Fatalf("peer reflexive candidates %v", reflexive)
+	}
+	if len(selected) != 1 || selected[0].Remote != reflexive[0] || selected[0].Local.Addr.String() != "1.0.0.1:3478" {
+		t.Fatalf("selected pairs %v", selected)
+	}
+	// Nominating the selected pair again reports nothing new.
+	send(natted, valid)
+	if len(selected) != 1 || agent.Selected() != selected[0] || len(agent.RemoteCandidates()) != 2 {
+		t.Errorf("selected pairs %v", selected)
+	}
+
+	if agent.Handle([]byte{0x80, 0x60, 0, 1}, direct.LocalAddr()) {
+		t.Errorf("media taken for STUN")
+	}
+}
+
+// discardConn is a socket which drops what is sent.
+type discardConn struct {
+	net.PacketConn
+	addr net.Addr
+}
+
+func (c discardConn) WriteTo(b []byte, addr net.Addr) (int, error) { return len(b), nil }
+func (c discardConn) LocalAddr() net.Addr                          { return c.addr }
+
+// newBenchCheck returns a nominating check of the peer 3.0.0.1:5000, which is
+// signalled to agent.
+func newBenchCheck(t testing.TB, agent *LiteAgent) ([]byte, net.Addr) {
+	remote, _ := ParseCandidate("candidate:1 1 udp 2130706431 3.0.0.1 5000 typ host")
+	agent.AddRemoteCandidate(remote)
+	pkt, err := newCheckRequest(&Peer{Username: "lite:full", Password: "litepassword"}, true, 1)
+	if err != nil {
+		t.Fatalf("newCheckRequest error: %v", err)
+	}
+	return pkt.bytes(), &net.UDPAddr{IP: net.ParseIP("3.0.0.1"), Port: 5000}
+}
+
+func TestLiteAgentAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	agent := NewLiteAgent(discardConn{addr: &net.UDPAddr{IP: net.ParseIP("1.0.0.1"), Port: 3478}}, "lite", "litepassword")
+	b, addr := newBenchCheck(t, agent)
+	// Only the first check nominates the pair, which allocates it.
+	if n := testing.AllocsPerRun(100, func() { agent.Handle(b, addr) }); n != 0 {
+		t.Errorf("Handle allocates %v times", n)
+	}
+	if p := agent.Selected(); p == nil || p.Remote.Addr.String() != "3.0.0.1:5000" {
+		t.Errorf("selected pair %v", p)
+	}
+}
+
+func BenchmarkLiteAgentHandle(b *testing.B) {
+	agent := NewLiteAgent(discardConn{addr: &net.UDPAddr{IP: net.ParseIP("1.0.0.1"), Port: 3478}}, "lite", "litepassword")
+	check, addr := newBenchCheck(b, agent)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		agent.Handle(check, addr)
+	}
+}
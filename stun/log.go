@@ -15,11 +15,58 @@
 package stun
 
 import (
+	"encoding/hex"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
-// Logger is a simple logger specified for this STUN client.
+// LogLevel is the severity of a log event. The values are the same as the
+// levels of log/slog, with an additional trace level.
+type LogLevel int
+
+// Log levels.
+const (
+	LevelTrace LogLevel = -8
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+// EventLogger receives the log events of a client. An event is a message
+// with alternating keys and values, like in log/slog. The events are "test
+// started", "packet sent", "retransmit", "packet received", "response
+// received", "response dropped", "error response", "source address
+// mismatch", "integrity check failed", "unknown attributes", "protocol
+// detected", "shared secret request", "shared secret obtained",
+// "classification", "consent refreshed", "consent check failed" and "consent
+// expired". Packet events are at the trace level and carry the hex
+// dump of the packet as the "hex" value.
+type EventLogger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {}
+
+// hexDump formats a packet only if the event is actually logged.
+type hexDump []byte
+
+func (h hexDump) String() string {
+	return hex.Dump(h)
+}
+
+// MarshalText makes structured handlers log the dump rather than base64.
+func (h hexDump) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// Logger is a simple logger specified for this STUN client. It is the
+// default EventLogger of a client, which prints trace events in info mode and
+// other events in debug mode.
 type Logger struct {
 	log.Logger
 	debug bool
@@ -83,3 +130,30 @@ func (l *Logger) Infoln(v ...interface{}) {
 		l.Println(v...)
 	}
 }
+
+// Log outputs an event as the message followed by key=value pairs. Multiline
+// values, like hex dumps, are put after the pairs.
+func (l *Logger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if (level <= LevelTrace && !l.info) || (level > LevelTrace && !l.debug) {
+		return
+	}
+	var b strings.Builder
+	var tail []string
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = "MISSING"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		s := fmt.Sprint(v)
+		if strings.Contains(s, "\n") {
+			tail = append(tail, s)
+			continue
+		}
+		fmt.Fprintf(&b, " %v=%s", keyvals[i], s)
+	}
+	for _, s := range tail {
+		b.WriteString("\n" + strings.TrimRight(s, "\n"))
+	}
+	l.Println(b.String())
+}
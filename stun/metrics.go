@@ -0,0 +1,50 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"time"
+)
+
+// Metrics receives the measurements of the STUN transactions of a client,
+// for monitoring. Servers are given as transport addresses. The methods may
+// be called by several goroutines at once.
+type Metrics interface {
+	// RequestSent is called for every request sent, including the
+	// retransmissions, which are also reported by Retransmission.
+	RequestSent(server string)
+	Retransmission(server string)
+	// Timeout is called when a transaction gives up without response.
+	Timeout(server string)
+	ErrorResponse(server string, code int)
+	// RTT is called with the round-trip time of every transaction which
+	// got a response to its first request.
+	RTT(server string, d time.Duration)
+	// NATType is called with the result of every successful Discover.
+	NATType(t NATType)
+	// NATBehavior is called with the result of every successful
+	// BehaviorTest.
+	NATBehavior(b *NATBehavior)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) RequestSent(server string)             {}
+func (nopMetrics) Retransmission(server string)          {}
+func (nopMetrics) Timeout(server string)                 {}
+func (nopMetrics) ErrorResponse(server string, code int) {}
+func (nopMetrics) RTT(server string, d time.Duration)    {}
+func (nopMetrics) NATType(t NATType)                     {}
+func (nopMetrics) NATBehavior(b *NATBehavior)            {}
@@ -0,0 +1,252 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default intervals of a monitor.
+const (
+	DefaultPollInterval       = 5 * time.Second
+	DefaultRevalidateInterval = time.Minute
+)
+
+// InterfaceAddr is an address of a local interface.
+type InterfaceAddr struct {
+	Name string     // of the interface, like "eth0"
+	Net  *net.IPNet // the address and the mask of its network
+}
+
+// String returns the name of the interface and the address in CIDR notation
+// separated by a space, like "eth0 192.0.2.1/24".
+func (a InterfaceAddr) String() string {
+	return a.Name + " " + a.Net.String()
+}
+
+// InterfaceSource lists the addresses of the local interfaces, which a
+// monitor polls to detect network changes.
+type InterfaceSource interface {
+	Addrs() ([]InterfaceAddr, error)
+}
+
+// systemInterfaces lists the addresses of the interfaces which are up,
+// excluding loopback ones.
+type systemInterfaces struct{}
+
+func (systemInterfaces) Addrs() ([]InterfaceAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []InterfaceAddr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaddrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				addrs = append(addrs, InterfaceAddr{Name: iface.Name, Net: ipnet})
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// sortInterfaceAddrs sorts addrs by their string form, so that lists of the
+// same addresses compare equal.
+func sortInterfaceAddrs(addrs []InterfaceAddr) {
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].String() < addrs[j].String() })
+}
+
+// joinInterfaceAddrs returns the string forms of addrs separated by commas.
+func joinInterfaceAddrs(addrs []InterfaceAddr) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// MonitorResult is a result of discovery published by a monitor.
+type MonitorResult struct {
+	Time     time.Time
+	Reason   string          // "started", "interfaces changed" or "mapping changed"
+	Addrs    []InterfaceAddr // local interface addresses, sorted
+	NAT      NATType
+	Host     *Host
+	Behavior *NATBehavior // nil unless behavior tests are enabled
+	Err      error        // error of Discover or BehaviorTest
+}
+
+// Monitor reruns discovery when the network changes. It polls the local
+// interface addresses, and periodically sends a Binding request to check the
+// mapped address. If the client has no connection, every request is sent
+// from a new socket, so only the mapped IP is checked.
+type Monitor struct {
+	client             *Client
+	source             InterfaceSource
+	pollInterval       time.Duration
+	revalidateInterval time.Duration
+	behavior           bool
+	results            chan MonitorResult
+}
+
+// NewMonitor returns a monitor which discovers with the client.
+func NewMonitor(c *Client) *Monitor {
+	m := new(Monitor)
+	m.client = c
+	m.source = systemInterfaces{}
+	m.pollInterval = DefaultPollInterval
+	m.revalidateInterval = DefaultRevalidateInterval
+	m.results = make(chan MonitorResult, 16)
+	return m
+}
+
+// SetInterfaceSource replaces the source of local interface addresses, which
+// is net.Interfaces by default.
+func (m *Monitor) SetInterfaceSource(s InterfaceSource) {
+	m.source = s
+}
+
+// SetPollInterval sets how often the interface addresses are polled.
+func (m *Monitor) SetPollInterval(d time.Duration) {
+	m.pollInterval = d
+}
+
+// SetRevalidateInterval sets how often the mapped address is checked.
+func (m *Monitor) SetRevalidateInterval(d time.Duration) {
+	m.revalidateInterval = d
+}
+
+// SetBehaviorTest sets whether BehaviorTest runs after every Discover.
+func (m *Monitor) SetBehaviorTest(v bool) {
+	m.behavior = v
+}
+
+// Results returns the channel of results, the first of which is published
+// when Run starts. It is closed when Run returns. The monitor stalls if the
+// results are not received.
+func (m *Monitor) Results() <-chan MonitorResult {
+	return m.results
+}
+
+// Run monitors the network until ctx is done, and returns the error of ctx.
+// It can only be called once.
+func (m *Monitor) Run(ctx context.Context) error {
+	defer close(m.results)
+	poll := time.NewTicker(m.pollInterval)
+	defer poll.Stop()
+	revalidate := time.NewTicker(m.revalidateInterval)
+	defer revalidate.Stop()
+
+	addrs, err := m.addrs()
+	if err != nil {
+		return err
+	}
+	last, err := m.discover(ctx, "started", addrs)
+	for err == nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-poll.C:
+			current, perr := m.addrs()
+			if perr != nil {
+				m.client.logger.Log(LevelWarn, "interface poll failed", "err", perr)
+				continue
+			}
+			if joinInterfaceAddrs(current) != joinInterfaceAddrs(last.Addrs) {
+				last, err = m.discover(ctx, "interfaces changed", current)
+			}
+		case <-revalidate.C:
+			if m.mappingKey(m.probe()) != m.mappingKey(last.Host) {
+				last, err = m.discover(ctx, "mapping changed", last.Addrs)
+			}
+		}
+	}
+	return err
+}
+
+func (m *Monitor) addrs() ([]InterfaceAddr, error) {
+	addrs, err := m.source.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	sortInterfaceAddrs(addrs)
+	return addrs, nil
+}
+
+// discover publishes a new result, and returns the error of ctx if it is
+// done meanwhile.
+func (m *Monitor) discover(ctx context.Context, reason string, addrs []InterfaceAddr) (MonitorResult, error) {
+	m.client.logger.Log(LevelInfo, "rediscover", "reason", reason)
+	if serverUDPAddr, err := m.client.resolveServer(); err == nil && reason != "started" {
+		m.client.invalidateCache(serverUDPAddr.String())
+	}
+	r := MonitorResult{Reason: reason, Addrs: addrs}
+	r.NAT, r.Host, r.Err = m.client.Discover()
+	if r.Err == nil && m.behavior {
+		r.Behavior, r.Err = m.client.BehaviorTest()
+	}
+	r.Time = time.Now()
+	select {
+	case m.results <- r:
+		return r, nil
+	case <-ctx.Done():
+		return r, ctx.Err()
+	}
+}
+
+// probe returns the mapped address of the client, or nil if the server does
+// not answer.
+func (m *Monitor) probe() *Host {
+	c := m.client
+	serverUDPAddr, err := c.resolveServer()
+	if err != nil {
+		return nil
+	}
+	conn, err := c.connection(serverUDPAddr)
+	if err != nil {
+		return nil
+	}
+	if conn != c.conn {
+		defer conn.Close()
+	}
+	resp, err := c.test1(conn, serverUDPAddr)
+	if err != nil || resp == nil {
+		return nil
+	}
+	return resp.mappedAddr
+}
+
+// mappingKey is the part of a mapped address which is expected to be stable
+// while the network does not change.
+func (m *Monitor) mappingKey(h *Host) string {
+	if h == nil {
+		return ""
+	}
+	if m.client.conn == nil {
+		return h.IP()
+	}
+	return h.String()
+}
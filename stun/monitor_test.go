@@ -0,0 +1,115 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+// fakeInterfaces is an interface source whose addresses tests change. The
+// addresses are given in their string form, like "eth0 192.0.2.1/24".
+type fakeInterfaces struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (f *fakeInterfaces) Addrs() ([]InterfaceAddr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var addrs []InterfaceAddr
+	for _, s := range f.addrs {
+		i := strings.LastIndex(s, " ")
+		ip, ipnet, err := net.ParseCIDR(s[i+1:])
+		if i < 0 || err != nil {
+			return nil, fmt.Errorf("invalid interface address %q", s)
+		}
+		addrs = append(addrs, InterfaceAddr{Name: s[:i], Net: &net.IPNet{IP: ip, Mask: ipnet.Mask}})
+	}
+	return addrs, nil
+}
+
+func (f *fakeInterfaces) set(addrs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addrs = addrs
+}
+
+func TestMonitor(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	nat, err := n.NewNAT("2.0.0.1", nattest.Config{Filtering: ad, PortAllocation: nattest.PortSequential})
+	if err != nil {
+		t.Fatalf("NewNAT error: %v", err)
+	}
+	conn, err := nat.ListenPacket("10.0.0.2", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+
+	ifaces := &fakeInterfaces{addrs: []string{"eth0 10.0.0.2/24"}}
+	m := NewMonitor(newTestClient(conn))
+	m.SetInterfaceSource(ifaces)
+	m.SetPollInterval(5 * time.Millisecond)
+	m.SetRevalidateInterval(5 * time.Millisecond)
+	m.SetBehaviorTest(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	next := func() MonitorResult {
+		select {
+		case r := <-m.Results():
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Monitor error: no result")
+		}
+		return MonitorResult{}
+	}
+	r := next()
+	if r.Reason != "started" || r.NAT != NATRestricted || r.Host.String() != "2.0.0.1:40000" ||
+		r.Behavior == nil || r.Behavior.MappingType != BehaviorTypeEndpoint || r.Err != nil {
+		t.Errorf("Monitor error: first result %+v", r)
+	}
+
+	ifaces.set("eth0 10.0.0.2/24", "wlan0 192.168.1.2/24")
+	r = next()
+	if r.Reason != "interfaces changed" || len(r.Addrs) != 2 || r.Addrs[1].Name != "wlan0" ||
+		!r.Addrs[1].Net.IP.Equal(net.ParseIP("192.168.1.2")) || r.Addrs[1].String() != "wlan0 192.168.1.2/24" {
+		t.Errorf("Monitor error: result %+v after interface change", r)
+	}
+
+	// The NAT reboots, so the next request gets a new mapping.
+	nat.Flush()
+	r = next()
+	if r.Reason != "mapping changed" || r.Host.String() != "2.0.0.1:40001" {
+		t.Errorf("Monitor error: result %+v after NAT reboot", r)
+	}
+
+	cancel()
+	for range m.Results() {
+	}
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run error: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nattest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+type datagram struct {
+	b    []byte
+	from *net.UDPAddr
+}
+
+// conn is a virtual UDP socket.
+type conn struct {
+	network *Network
+	nat     *NAT // nil on the public network
+	addr    *net.UDPAddr
+	queue   chan datagram
+	closed  chan struct{}
+	once    sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+	changed  chan struct{} // closed when the read deadline changes
+}
+
+var errClosed = errors.New("use of closed network connection")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func newConn(n *Network, nat *NAT, addr *net.UDPAddr) *conn {
+	return &conn{
+		network: n,
+		nat:     nat,
+		addr:    addr,
+		queue:   make(chan datagram, queueSize),
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+// deliver queues a datagram, or drops it if the queue is full.
+func (c *conn) deliver(b []byte, from *net.UDPAddr) {
+	select {
+	case c.queue <- datagram{b, from}:
+	default:
+	}
+}
+
+func (c *conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.changed
+		c.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, c.opError("read", timeoutError{})
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+		select {
+		case p := <-c.queue:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, p.b), p.from, nil
+		case <-c.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, nil, c.opError("read", errClosed)
+		case <-expired:
+			return 0, nil, c.opError("read", timeoutError{})
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (c *conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", errClosed)
+	default:
+	}
+	dst, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, c.opError("write", err)
+	}
+	if v4 := dst.IP.To4(); v4 != nil {
+		dst.IP = v4
+	}
+	p := make([]byte, len(b))
+	copy(p, b)
+	c.network.mu.Lock()
+	c.network.send(c, p, dst)
+	c.network.mu.Unlock()
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	err := c.opError("close", errClosed)
+	c.once.Do(func() {
+		c.network.release(c)
+		close(c.closed)
+		err = nil
+	})
+	return err
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes never block.
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.addr, Err: err}
+}
@@ -0,0 +1,250 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nattest
+
+import (
+	"net"
+	"time"
+)
+
+// Behavior is the mapping or filtering behavior of a NAT, defined in
+// RFC 4787.
+type Behavior int
+
+// Behaviors.
+const (
+	EndpointIndependent Behavior = iota
+	AddressDependent
+	AddressAndPortDependent
+)
+
+// PortAllocation is how a NAT chooses the external port of a new mapping.
+type PortAllocation int
+
+// Port allocation strategies. If the port cannot be preserved, the next free
+// port is used.
+const (
+	PortPreservation PortAllocation = iota
+	PortSequential
+	PortRandom
+)
+
+const firstExternalPort = 40000
+
+// Config is the behavior of a NAT. The zero value is a full cone NAT which
+// preserves ports and never expires its bindings.
+//
+// A firewall which does not translate addresses is a NAT whose public IP is
+// the IP of the host behind it, with port preservation.
+type Config struct {
+	Mapping        Behavior
+	Filtering      Behavior
+	Hairpinning    bool
+	PortAllocation PortAllocation
+	BindingTimeout time.Duration // idle time before a binding expires, 0 for never
+	LossRate       float64       // probability of dropping a packet crossing the NAT
+}
+
+// NAT translates the addresses of the hosts behind it to its public IP.
+type NAT struct {
+	network  *Network
+	ip       net.IP
+	config   Config
+	conns    map[string]*conn    // private sockets by transport address
+	mappings map[string]*mapping // mappings by mapping key
+	ports    map[int]*mapping    // mappings by external port
+	nextPort int
+}
+
+type mapping struct {
+	key        string
+	internal   *net.UDPAddr
+	external   *net.UDPAddr
+	allowed    map[string]bool // remote IPs or transport addresses, by filtering
+	lastActive time.Time
+}
+
+func newNAT(n *Network, ip net.IP, config Config) *NAT {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	nat := new(NAT)
+	nat.network = n
+	nat.ip = ip
+	nat.config = config
+	nat.conns = make(map[string]*conn)
+	nat.mappings = make(map[string]*mapping)
+	nat.ports = make(map[int]*mapping)
+	nat.nextPort = firstExternalPort
+	return nat
+}
+
+// IP returns the public IP of the NAT.
+func (nat *NAT) IP() net.IP {
+	return nat.ip
+}
+
+// ListenPacket returns a socket behind the NAT. If port is 0, an ephemeral
+// port is picked.
+func (nat *NAT) ListenPacket(ip string, port int) (net.PacketConn, error) {
+	n := nat.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr, err := n.bind(ip, port, nat.conns)
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(n, nat, addr)
+	nat.conns[addr.String()] = c
+	return c, nil
+}
+
+// Mapping returns the external address the NAT currently uses for packets
+// from internal to remote, or nil if there is no such binding.
+func (nat *NAT) Mapping(internal, remote net.Addr) net.Addr {
+	in, err1 := net.ResolveUDPAddr("udp", internal.String())
+	re, err2 := net.ResolveUDPAddr("udp", remote.String())
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	nat.network.mu.Lock()
+	defer nat.network.mu.Unlock()
+	m := nat.lookup(nat.mappingKey(in, re))
+	if m == nil {
+		return nil
+	}
+	return m.external
+}
+
+// Flush drops all bindings, like a rebooted NAT.
+func (nat *NAT) Flush() {
+	nat.network.mu.Lock()
+	defer nat.network.mu.Unlock()
+	nat.mappings = make(map[string]*mapping)
+	nat.ports = make(map[int]*mapping)
+}
+
+func (nat *NAT) mappingKey(internal, remote *net.UDPAddr) string {
+	switch nat.config.Mapping {
+	case AddressDependent:
+		return internal.String() + "/" + remote.IP.String()
+	case AddressAndPortDependent:
+		return internal.String() + "/" + remote.String()
+	}
+	return internal.String()
+}
+
+func (nat *NAT) filterKey(remote *net.UDPAddr) string {
+	if nat.config.Filtering == AddressAndPortDependent {
+		return remote.String()
+	}
+	return remote.IP.String()
+}
+
+// lookup returns the mapping of key, and removes it if it has expired.
+func (nat *NAT) lookup(key string) *mapping {
+	m := nat.mappings[key]
+	if m == nil {
+		return nil
+	}
+	if nat.expired(m) {
+		delete(nat.mappings, key)
+		delete(nat.ports, m.external.Port)
+		return nil
+	}
+	return m
+}
+
+func (nat *NAT) expired(m *mapping) bool {
+	timeout := nat.config.BindingTimeout
+	return timeout > 0 && nat.network.now().Sub(m.lastActive) >= timeout
+}
+
+// outbound translates the source address of a packet to remote, creating a
+// mapping if there is none.
+func (nat *NAT) outbound(internal, remote *net.UDPAddr) *net.UDPAddr {
+	key := nat.mappingKey(internal, remote)
+	m := nat.lookup(key)
+	if m == nil {
+		m = &mapping{
+			key:      key,
+			internal: internal,
+			external: &net.UDPAddr{IP: nat.ip, Port: nat.allocatePort(internal.Port)},
+			allowed:  make(map[string]bool),
+		}
+		nat.mappings[key] = m
+		nat.ports[m.external.Port] = m
+	}
+	m.allowed[nat.filterKey(remote)] = true
+	m.lastActive = nat.network.now()
+	return m.external
+}
+
+// inbound delivers a packet from remote to the host behind the NAT, if the
+// filtering behavior allows.
+func (nat *NAT) inbound(b []byte, remote, dst *net.UDPAddr) {
+	m := nat.ports[dst.Port]
+	if m == nil || nat.lookup(m.key) == nil {
+		return
+	}
+	if nat.config.Filtering != EndpointIndependent && !m.allowed[nat.filterKey(remote)] {
+		return
+	}
+	if c := nat.conns[m.internal.String()]; c != nil {
+		c.deliver(b, remote)
+	}
+}
+
+func (nat *NAT) allocatePort(internalPort int) int {
+	free := func(port int) bool {
+		if port <= 0 || port > 65535 {
+			return false
+		}
+		m := nat.ports[port]
+		return m == nil || nat.lookup(m.key) == nil
+	}
+	switch nat.config.PortAllocation {
+	case PortPreservation:
+		if free(internalPort) {
+			return internalPort
+		}
+	case PortRandom:
+		for i := 0; i < 100; i++ {
+			port := 1024 + nat.network.rand.Intn(65536-1024)
+			if free(port) {
+				return port
+			}
+		}
+	}
+	for !free(nat.nextPort) {
+		nat.nextPort++
+		if nat.nextPort > 65535 {
+			nat.nextPort = 1024
+		}
+	}
+	port := nat.nextPort
+	nat.nextPort++
+	return port
+}
+
+func (nat *NAT) lose() bool {
+	return nat.config.LossRate > 0 && nat.network.rand.Float64() < nat.config.LossRate
+}
+
+func (nat *NAT) release(c *conn) {
+	if nat.conns[c.addr.String()] == c {
+		delete(nat.conns, c.addr.String())
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nattest
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, l interface {
+	ListenPacket(string, int) (net.PacketConn, error)
+}, ip string, port int) net.PacketConn {
+	conn, err := l.ListenPacket(ip, port)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	return conn
+}
+
+func addNAT(t *testing.T, n *Network, ip string, config Config) *NAT {
+	nat, err := n.NewNAT(ip, config)
+	if err != nil {
+		t.Fatalf("NewNAT error: %v", err)
+	}
+	return nat
+}
+
+// exchange sends a datagram from one socket to addr and returns the source
+// address seen by the receiver, or nil if it was dropped.
+func exchange(t *testing.T, from, to net.PacketConn, addr net.Addr) net.Addr {
+	if _, err := from.WriteTo([]byte("ping"), addr); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	to.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 16)
+	n, src, err := to.ReadFrom(buf)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil
+		}
+		t.Fatalf("ReadFrom error: %v", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("ReadFrom error: get %q", buf[:n])
+	}
+	return src
+}
+
+func TestMapping(t *testing.T) {
+	for _, behavior := range []Behavior{EndpointIndependent, AddressDependent, AddressAndPortDependent} {
+		n := NewNetwork()
+		nat := addNAT(t, n, "2.0.0.1", Config{Mapping: behavior})
+		client := listen(t, nat, "10.0.0.2", 5000)
+		s11 := listen(t, n, "1.0.0.1", 3478)
+		s12 := listen(t, n, "1.0.0.1", 3479)
+		s21 := listen(t, n, "1.0.0.2", 3478)
+		m11 := exchange(t, client, s11, s11.LocalAddr())
+		m12 := exchange(t, client, s12, s12.LocalAddr())
+		m21 := exchange(t, client, s21, s21.LocalAddr())
+		if m11 == nil || m12 == nil || m21 == nil {
+			t.Fatalf("Mapping %d error: packet dropped", behavior)
+		}
+		if m11.String() != "2.0.0.1:5000" {
+			t.Errorf("Mapping %d error: port not preserved, get %v", behavior, m11)
+		}
+		if (m11.String() == m12.String()) != (behavior != AddressAndPortDependent) {
+			t.Errorf("Mapping %d error: get %v and %v to another port", behavior, m11, m12)
+		}
+		if (m11.String() == m21.String()) != (behavior == EndpointIndependent) {
+			t.Errorf("Mapping %d error: get %v and %v to another IP", behavior, m11, m21)
+		}
+	}
+}
+
+func TestFiltering(t *testing.T) {
+	for _, behavior := range []Behavior{EndpointIndependent, AddressDependent, AddressAndPortDependent} {
+		n := NewNetwork()
+		nat := addNAT(t, n, "2.0.0.1", Config{Filtering: behavior})
+		client := listen(t, nat, "10.0.0.2", 5000)
+		s11 := listen(t, n, "1.0.0.1", 3478)
+		s12 := listen(t, n, "1.0.0.1", 3479)
+		s21 := listen(t, n, "1.0.0.2", 3478)
+		mapped := exchange(t, client, s11, s11.LocalAddr())
+		if exchange(t, s11, client, mapped) == nil {
+			t.Errorf("Filtering %d error: response dropped", behavior)
+		}
+		if (exchange(t, s12, client, mapped) != nil) != (behavior != AddressAndPortDependent) {
+			t.Errorf("Filtering %d error: from another port", behavior)
+		}
+		if (exchange(t, s21, client, mapped) != nil) != (behavior == EndpointIndependent) {
+			t.Errorf("Filtering %d error: from another IP", behavior)
+		}
+	}
+}
+
+func TestHairpinning(t *testing.T) {
+	for _, hairpinning := range []bool{false, true} {
+		n := NewNetwork()
+		nat := addNAT(t, n, "2.0.0.1", Config{Hairpinning: hairpinning})
+		a := listen(t, nat, "10.0.0.2", 5000)
+		b := listen(t, nat, "10.0.0.3", 6000)
+		s := listen(t, n, "1.0.0.1", 3478)
+		exchange(t, a, s, s.LocalAddr())
+		mappedB := exchange(t, b, s, s.LocalAddr())
+		src := exchange(t, a, b, mappedB)
+		if (src != nil) != hairpinning {
+			t.Errorf("Hairpinning %v error: get %v", hairpinning, src)
+		}
+		if src != nil && src.String() != "2.0.0.1:5000" {
+			t.Errorf("Hairpinning error: source not translated, get %v", src)
+		}
+		if exchange(t, a, b, b.LocalAddr()) == nil {
+			t.Errorf("Hairpinning error: private address unreachable")
+		}
+	}
+}
+
+func TestPortAllocation(t *testing.T) {
+	n := NewNetwork()
+	nat := addNAT(t, n, "2.0.0.1", Config{Mapping: AddressAndPortDependent, PortAllocation: PortSequential})
+	client := listen(t, nat, "10.0.0.2", 5000)
+	s1 := listen(t, n, "1.0.0.1", 3478)
+	s2 := listen(t, n, "1.0.0.1", 3479)
+	if m := exchange(t, client, s1, s1.LocalAddr()); m.String() != "2.0.0.1:40000" {
+		t.Errorf("PortSequential error: get %v", m)
+	}
+	if m := exchange(t, client, s2, s2.LocalAddr()); m.String() != "2.0.0.1:40001" {
+		t.Errorf("PortSequential error: get %v", m)
+	}
+	nat = addNAT(t, n, "2.0.0.2", Config{PortAllocation: PortRandom})
+	client = listen(t, nat, "10.0.0.2", 5000)
+	if m := exchange(t, client, s1, s1.LocalAddr()); m.String() == "2.0.0.2:5000" {
+		t.Errorf("PortRandom error: get %v", m)
+	}
+}
+
+func TestBindingTimeout(t *testing.T) {
+	now := time.Now()
+	n := NewNetwork()
+	n.SetClock(func() time.Time { return now })
+	nat := addNAT(t, n, "2.0.0.1", Config{BindingTimeout: time.Minute, PortAllocation: PortSequential})
+	client := listen(t, nat, "10.0.0.2", 5000)
+	s := listen(t, n, "1.0.0.1", 3478)
+	mapped := exchange(t, client, s, s.LocalAddr())
+	now = now.Add(59 * time.Second)
+	if exchange(t, s, client, mapped) == nil {
+		t.Errorf("BindingTimeout error: expired too early")
+	}
+	now = now.Add(time.Minute)
+	if exchange(t, s, client, mapped) != nil {
+		t.Errorf("BindingTimeout error: not expired")
+	}
+	if nat.Mapping(client.LocalAddr(), s.LocalAddr()) != nil {
+		t.Errorf("BindingTimeout error: mapping not removed")
+	}
+	if m := exchange(t, client, s, s.LocalAddr()); m.String() == mapped.String() {
+		t.Errorf("BindingTimeout error: mapping reused")
+	}
+}
+
+func TestLoss(t *testing.T) {
+	n := NewNetwork()
+	nat := addNAT(t, n, "2.0.0.1", Config{LossRate: 0.5})
+	client := listen(t, nat, "10.0.0.2", 5000)
+	s := listen(t, n, "1.0.0.1", 3478)
+	received := 0
+	for i := 0; i < 100; i++ {
+		if exchange(t, client, s, s.LocalAddr()) != nil {
+			received++
+		}
+	}
+	if received < 30 || received > 70 {
+		t.Errorf("Loss error: %d of 100 received", received)
+	}
+}
+
+func TestConn(t *testing.T) {
+	n := NewNetwork()
+	a := listen(t, n, "1.0.0.1", 0)
+	if _, err := n.ListenPacket("1.0.0.1", a.LocalAddr().(*net.UDPAddr).Port); err == nil {
+		t.Errorf("ListenPacket error: address reused")
+	}
+	done := make(chan error)
+	go func() {
+		_, _, err := a.ReadFrom(make([]byte, 16))
+		done <- err
+	}()
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err := <-done; err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("ReadFrom error: expected timeout, get %v", err)
+	}
+	a.SetReadDeadline(time.Time{})
+	go func() {
+		_, _, err := a.ReadFrom(make([]byte, 16))
+		done <- err
+	}()
+	a.Close()
+	if err := <-done; err == nil {
+		t.Errorf("ReadFrom error: expected closed")
+	}
+	if a.Close() == nil {
+		t.Errorf("Close error: closed twice")
+	}
+}
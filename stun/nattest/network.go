@@ -0,0 +1,190 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nattest provides an in-process network of virtual UDP sockets,
+// whose traffic can be routed through NATs of configurable behavior. It
+// allows testing NAT traversal without a real NAT.
+//
+// Hosts on the public network are created by Network.ListenPacket, and hosts
+// behind a NAT by NAT.ListenPacket. All of them are net.PacketConn.
+//
+//	n := nattest.NewNetwork()
+//	server, _ := n.ListenPacket("1.0.0.1", 3478)
+//	nat, _ := n.NewNAT("2.0.0.1", nattest.Config{})
+//	client, _ := nat.ListenPacket("10.0.0.2", 5000)
+package nattest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ephemeralPort = 49152
+	queueSize     = 256
+)
+
+// Network is a virtual network, which delivers datagrams between the virtual
+// sockets instantly and in order. Datagrams to an address nobody listens on
+// are dropped silently.
+type Network struct {
+	mu    sync.Mutex
+	hosts map[string]*conn // public sockets by transport address
+	nats  map[string]*NAT  // NATs by public IP
+	ports map[string]int   // next ephemeral port by IP
+	rand  *rand.Rand
+	now   func() time.Time
+}
+
+// NewNetwork returns an empty network. Packet loss is decided by a random
+// source with a fixed seed, so that a test behaves the same in every run.
+func NewNetwork() *Network {
+	n := new(Network)
+	n.hosts = make(map[string]*conn)
+	n.nats = make(map[string]*NAT)
+	n.ports = make(map[string]int)
+	n.rand = rand.New(rand.NewSource(1))
+	n.now = time.Now
+	return n
+}
+
+// SetSeed sets the seed of the random source deciding packet loss and random
+// port allocation.
+func (n *Network) SetSeed(seed int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rand = rand.New(rand.NewSource(seed))
+}
+
+// SetClock sets the function returning the current time, which is used to
+// expire NAT bindings. It allows tests to advance the time by hand.
+func (n *Network) SetClock(now func() time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.now = now
+}
+
+// ListenPacket returns a socket on the public network. If port is 0, an
+// ephemeral port is picked.
+func (n *Network) ListenPacket(ip string, port int) (net.PacketConn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr, err := n.bind(ip, port, n.hosts)
+	if err != nil {
+		return nil, err
+	}
+	if n.nats[addr.IP.String()] != nil {
+		return nil, errors.New("nattest: address is used by a NAT: " + ip)
+	}
+	c := newConn(n, nil, addr)
+	n.hosts[addr.String()] = c
+	return c, nil
+}
+
+// NewNAT adds a NAT with the given public IP to the network.
+func (n *Network) NewNAT(publicIP string, config Config) (*NAT, error) {
+	ip := net.ParseIP(publicIP)
+	if ip == nil {
+		return nil, errors.New("nattest: invalid IP: " + publicIP)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nats[ip.String()] != nil {
+		return nil, errors.New("nattest: NAT exists: " + publicIP)
+	}
+	nat := newNAT(n, ip, config)
+	n.nats[ip.String()] = nat
+	return nat, nil
+}
+
+// bind resolves the address of a new socket, and picks a port if needed.
+func (n *Network) bind(ip string, port int, used map[string]*conn) (*net.UDPAddr, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsUnspecified() {
+		return nil, errors.New("nattest: invalid IP: " + ip)
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		parsed = v4
+	}
+	addr := &net.UDPAddr{IP: parsed, Port: port}
+	if port == 0 {
+		for {
+			next := n.ports[parsed.String()]
+			if next == 0 || next > 65535 {
+				next = ephemeralPort
+			}
+			n.ports[parsed.String()] = next + 1
+			addr.Port = next
+			if used[addr.String()] == nil {
+				break
+			}
+		}
+	}
+	if used[addr.String()] != nil {
+		return nil, errors.New("nattest: address in use: " + addr.String())
+	}
+	return addr, nil
+}
+
+// send routes a datagram from c to dst. It is called with n.mu held.
+func (n *Network) send(c *conn, b []byte, dst *net.UDPAddr) {
+	src := c.addr
+	if c.nat != nil {
+		nat := c.nat
+		// Hosts behind the same NAT talk to each other directly.
+		if peer := nat.conns[dst.String()]; peer != nil && !dst.IP.Equal(nat.ip) {
+			peer.deliver(b, src)
+			return
+		}
+		if nat.lose() {
+			return
+		}
+		src = nat.outbound(c.addr, dst)
+		if dst.IP.Equal(nat.ip) {
+			if nat.config.Hairpinning {
+				nat.inbound(b, src, dst)
+			}
+			return
+		}
+	}
+	n.deliver(b, src, dst)
+}
+
+// deliver routes a datagram on the public network.
+func (n *Network) deliver(b []byte, src, dst *net.UDPAddr) {
+	if nat := n.nats[dst.IP.String()]; nat != nil {
+		if !nat.lose() {
+			nat.inbound(b, src, dst)
+		}
+		return
+	}
+	if c := n.hosts[dst.String()]; c != nil {
+		c.deliver(b, src)
+	}
+}
+
+func (n *Network) release(c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c.nat != nil {
+		c.nat.release(c)
+		return
+	}
+	if n.hosts[c.addr.String()] == c {
+		delete(n.hosts, c.addr.String())
+	}
+}
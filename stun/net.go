@@ -15,8 +15,7 @@
 package stun
 
 import (
-	"bytes"
-	"encoding/hex"
+	"context"
 	"errors"
 	"net"
 	"time"
@@ -30,26 +29,47 @@ const (
 )
 
 func (c *Client) sendBindingReq(conn net.PacketConn, addr net.Addr, changeIP bool, changePort bool) (*response, error) {
-	// Construct packet.
-	pkt, err := newPacket()
+	pkt, err := c.newBindingReq(changeIP, changePort)
+	if err != nil {
+		return nil, err
+	}
+	// Send packet.
+	return c.send(pkt, conn, addr)
+}
+
+// newBindingReq constructs a Binding request, with the extra attributes
+// before the credentials and FINGERPRINT. A request of RFC 3489 has neither
+// SOFTWARE nor FINGERPRINT.
+func (c *Client) newBindingReq(changeIP bool, changePort bool, extra ...attribute) (*packet, error) {
+	legacy := c.legacy()
+	var pkt *packet
+	var err error
+	if legacy {
+		pkt, err = newLegacyPacket()
+	} else {
+		pkt, err = newPacket()
+	}
 	if err != nil {
 		return nil, err
 	}
 	pkt.types = typeBindingRequest
-	attribute := newSoftwareAttribute(c.softwareName)
-	pkt.addAttribute(*attribute)
+	if !legacy {
+		pkt.addAttribute(*newSoftwareAttribute(c.softwareName))
+	}
 	if changeIP || changePort {
-		attribute = newChangeReqAttribute(changeIP, changePort)
-		pkt.addAttribute(*attribute)
+		pkt.addAttribute(*newChangeReqAttribute(changeIP, changePort))
 	}
-	// length of fingerprint attribute must be included into crc,
-	// so we add it before calculating crc, then subtract it after calculating crc.
-	pkt.length += 8
-	attribute = newFingerprintAttribute(pkt)
-	pkt.length -= 8
-	pkt.addAttribute(*attribute)
-	// Send packet.
-	return c.send(pkt, conn, addr)
+	for _, a := range extra {
+		pkt.addAttribute(a)
+	}
+	if username, key := c.credentials(); key != nil {
+		pkt.addAttribute(*newUsernameAttribute(username))
+		pkt.addIntegrity(key)
+	}
+	if !legacy {
+		pkt.addFingerprint()
+	}
+	return pkt, nil
 }
 
 // RFC 3489: Clients SHOULD retransmit the request starting with an interval
@@ -57,48 +77,141 @@ func (c *Client) sendBindingReq(conn net.PacketConn, addr net.Addr, changeIP boo
 // Retransmissions continue with intervals of 1.6s until a response is
 // received, or a total of 9 requests have been sent.
 func (c *Client) send(pkt *packet, conn net.PacketConn, addr net.Addr) (*response, error) {
-	c.logger.Info("\n" + hex.Dump(pkt.bytes()))
-	timeout := defaultTimeout
-	packetBytes := make([]byte, maxPacketSize)
-	for i := 0; i < numRetransmit; i++ {
-		// Send packet to the server.
-		length, err := conn.WriteTo(pkt.bytes(), addr)
-		if err != nil {
-			return nil, err
-		}
-		if length != len(pkt.bytes()) {
-			return nil, errors.New("Error in sending data")
+	return c.exchange(pkt, conn, conn, addr)
+}
+
+// exchange works like send, but sends the request through out and waits for
+// the response on in, which differ when the response is redirected to
+// another socket. Responses are received through the transaction table of
+// in, so that many transactions may be pending on a socket at once.
+func (c *Client) exchange(pkt *packet, out, in net.PacketConn, addr net.Addr) (*response, error) {
+	return c.exchangeContext(context.Background(), pkt, out, in, addr)
+}
+
+// exchangeContext works like exchange, but gives up when ctx is done.
+func (c *Client) exchangeContext(ctx context.Context, pkt *packet, out, in net.PacketConn, addr net.Addr) (*response, error) {
+	timeout := c.rtt.rto(addr.String(), time.Duration(c.timeout)*time.Millisecond)
+	return c.transact(ctx, pkt, out, in, addr, c.numRetransmit, timeout)
+}
+
+// transact sends a request at most attempts times, starting with the
+// timeout, and samples the round-trip time of the response. It returns the
+// error of ctx if ctx is done before.
+func (c *Client) transact(ctx context.Context, pkt *packet, out, in net.PacketConn, addr net.Addr, attempts int, timeout time.Duration) (*response, error) {
+	var accept func(*packet, net.Addr) bool
+	if c.strict {
+		accept = func(p *packet, from net.Addr) bool {
+			return c.accept(pkt, p, addr, from)
 		}
-		err = conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+	}
+	t, ch, state := startTransaction(in, pkt.transID, accept)
+	defer t.remove(pkt.transID)
+	// Every retransmission is the same, so the request is encoded once,
+	// into a pooled buffer which is kept until the transaction ends.
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	*buf = pkt.encode((*buf)[:0])
+	b := *buf
+	for i := 0; i < attempts; i++ {
+		sent, err := c.write(b, out, addr, i)
 		if err != nil {
 			return nil, err
 		}
-		if timeout < maxTimeout {
+		timer := time.NewTimer(timeout)
+		if timeout < maxTimeout*time.Millisecond {
 			timeout *= 2
 		}
-		for {
-			// Read from the port.
-			length, raddr, err := conn.ReadFrom(packetBytes)
-			if err != nil {
-				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-					break
+		select {
+		case r := <-ch:
+			timer.Stop()
+			c.captureDatagram(r.time, r.addr, in.LocalAddr(), r.pkt.raw)
+			resp := c.received(r.pkt, out, r.addr, i, sent, r.time)
+			// RFC 3489: SOURCE-ADDRESS must be the address the
+			// response came from, which a server behind a NAT may
+			// get wrong, so only the strict mode insists on it.
+			if resp.sourceAddr != nil && resp.sourceAddr.String() != resp.serverAddr.String() {
+				c.logger.Log(LevelWarn, "source address mismatch", "from", r.addr,
+					"source", resp.sourceAddr)
+				if c.strict {
+					return nil, errors.New("Server error: source address")
+				}
+			}
+			if _, key := c.credentials(); key != nil && resp.errorCode == 0 && !r.pkt.checkIntegrity(key) {
+				c.logger.Log(LevelWarn, "integrity check failed", "from", r.addr)
+				return nil, errors.New("Server error: message integrity")
+			}
+			if c.strict {
+				if types := r.pkt.unknownRequired(); len(types) > 0 {
+					c.logger.Log(LevelWarn, "unknown attributes", "from", r.addr, "types", types)
+					return nil, &UnknownAttributesError{types}
 				}
-				return nil, err
 			}
-			p, err := newPacketFromBytes(packetBytes[0:length])
-			if err != nil {
-				return nil, err
+			if i == 0 {
+				c.rtt.sample(addr.String(), resp.rtt)
+				c.metrics.RTT(addr.String(), resp.rtt)
 			}
-			// If transId mismatches, keep reading until get a
-			// matched packet or timeout.
-			if !bytes.Equal(pkt.transID, p.transID) {
-				continue
+			if resp.errorCode != 0 {
+				c.logger.Log(LevelWarn, "error response", "from", r.addr, "code", resp.errorCode,
+					"reason", resp.errorReason)
+				c.metrics.ErrorResponse(addr.String(), resp.errorCode)
 			}
-			c.logger.Info("\n" + hex.Dump(packetBytes[0:length]))
-			resp := newResponse(p, conn)
-			resp.serverAddr = newHostFromStr(raddr.String())
-			return resp, err
+			return resp, nil
+		case <-state.done:
+			timer.Stop()
+			return nil, state.err
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
 		}
 	}
+	c.metrics.Timeout(addr.String())
 	return nil, nil
 }
+
+// write sends b, the attempt-th transmission of a request.
+func (c *Client) write(b []byte, out net.PacketConn, addr net.Addr, attempt int) (time.Time, error) {
+	if attempt > 0 {
+		c.logger.Log(LevelDebug, "retransmit", "to", addr, "attempt", attempt+1)
+		c.metrics.Retransmission(addr.String())
+	}
+	c.logger.Log(LevelTrace, "packet sent", "to", addr, "size", len(b), "hex", hexDump(b))
+	length, err := out.WriteTo(b, addr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if length != len(b) {
+		return time.Time{}, errors.New("Error in sending data")
+	}
+	sent := time.Now()
+	c.metrics.RequestSent(addr.String())
+	c.captureDatagram(sent, out.LocalAddr(), addr, b)
+	return sent, nil
+}
+
+// received builds the response, received at at, of the attempt-th
+// transmission, which is sent at sent through out.
+func (c *Client) received(p *packet, out net.PacketConn, raddr net.Addr, attempt int, sent, at time.Time) *response {
+	c.logger.Log(LevelTrace, "packet received", "from", raddr, "size", len(p.raw),
+		"hex", hexDump(p.raw))
+	c.detectProtocol(p)
+	resp := newResponse(p, out, c.legacy())
+	resp.serverAddr = newHostFromStr(raddr.String())
+	resp.attempts = attempt + 1
+	resp.rtt = at.Sub(sent)
+	c.logger.Log(LevelDebug, "response received", "from", raddr, "attempt", resp.attempts,
+		"rtt", resp.rtt, "mapped", resp.mappedAddr, "other", resp.otherAddr,
+		"changed", resp.changedAddr)
+	return resp
+}
+
+// captureDatagram writes a datagram to the capture writer, if any. Failing
+// to capture does not fail the exchange.
+func (c *Client) captureDatagram(t time.Time, src, dst net.Addr, b []byte) {
+	if c.capture == nil {
+		return
+	}
+	if err := c.capture.writeDatagram(t, src, dst, b); err != nil {
+		c.logger.Log(LevelWarn, "capture failed", "err", err)
+	}
+}
@@ -15,10 +15,15 @@
 package stun
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"math"
+	"net"
+	"sync"
 )
 
 type packet struct {
@@ -26,6 +31,8 @@ type packet struct {
 	length     uint16
 	transID    []byte // 4 bytes magic cookie + 12 bytes transaction id
 	attributes []attribute
+	raw        []byte // the received bytes, nil if built locally
+	buf        []byte // values of the attributes added in place, kept by respond
 }
 
 func newPacket() (*packet, error) {
@@ -41,53 +48,324 @@ func newPacket() (*packet, error) {
 	return v, nil
 }
 
-func newPacketFromBytes(packetBytes []byte) (*packet, error) {
-	if len(packetBytes) < 20 {
-		return nil, errors.New("Received data length too short")
+// newLegacyPacket returns a packet of RFC 3489, whose transaction ID is 128
+// random bits without the magic cookie.
+func newLegacyPacket() (*packet, error) {
+	v := new(packet)
+	v.transID = make([]byte, 16)
+	if _, err := rand.Read(v.transID); err != nil {
+		return nil, err
+	}
+	// Make sure the ID is not taken for the magic cookie.
+	if binary.BigEndian.Uint32(v.transID[:4]) == magicCookie {
+		v.transID[0] ^= 0xff
 	}
-	if len(packetBytes) > math.MaxUint16+20 {
-		return nil, errors.New("Received data length too long")
+	v.attributes = make([]attribute, 0, 10)
+	return v, nil
+}
+
+// legacy tells whether the packet is of RFC 3489, without the magic cookie.
+func (v *packet) legacy() bool {
+	return binary.BigEndian.Uint32(v.transID[:4]) != magicCookie
+}
+
+// newBindingResponse returns the success response to the Binding request req
+// received from addr, which carries XOR-MAPPED-ADDRESS.
+func newBindingResponse(req *packet, addr *net.UDPAddr) *packet {
+	v := new(packet)
+	v.respond(req, typeBindingResponse)
+	v.addXorAddr(attributeXorMappedAddress, addr)
+	return v
+}
+
+// newErrorResponse returns the error response to the request req.
+func newErrorResponse(req *packet, code int, reason string) *packet {
+	v := new(packet)
+	v.respondError(req, code, reason)
+	return v
+}
+
+// respond empties v into a response of the given type to req. The buffers of
+// v are kept, so that a server which reuses v builds responses without
+// allocating.
+func (v *packet) respond(req *packet, types uint16) {
+	v.types = types
+	v.length = 0
+	v.transID = req.transID
+	if v.attributes == nil {
+		v.attributes = make([]attribute, 0, 10)
 	}
+	v.attributes = v.attributes[:0]
+	v.raw = nil
+	v.buf = v.buf[:0]
+}
+
+// respondError empties v into the error response to req, like respond.
+func (v *packet) respondError(req *packet, code int, reason string) {
+	v.respond(req, req.types|0x0110)
+	start := len(v.buf)
+	v.buf = append(v.buf, 0, 0, byte(code/100), byte(code%100))
+	v.buf = append(v.buf, reason...)
+	v.addValue(attributeErrorCode, start)
+}
+
+// addValue adds the attribute whose value has been appended to v.buf from
+// start. The value is not padded, which encode does.
+func (v *packet) addValue(types uint16, start int) {
+	value := v.buf[start:len(v.buf):len(v.buf)]
+	v.addAttribute(attribute{types, uint16(len(value)), value})
+}
+
+// addString adds the attribute whose value is s, without allocating.
+func (v *packet) addString(types uint16, s string) {
+	start := len(v.buf)
+	v.buf = append(v.buf, s...)
+	v.addValue(types, start)
+}
+
+// addXorAddr adds the XOR address attribute of addr, without allocating.
+func (v *packet) addXorAddr(types uint16, addr *net.UDPAddr) {
+	start := len(v.buf)
+	v.buf = appendXorAddr(v.buf, addr, v.transID)
+	v.addValue(types, start)
+}
+
+// addRawAddr adds the address attribute of addr, without allocating.
+func (v *packet) addRawAddr(types uint16, addr *net.UDPAddr) {
+	start := len(v.buf)
+	v.buf = appendRawAddr(v.buf, addr)
+	v.addValue(types, start)
+}
+
+// newPacketFromBytes decodes a STUN message, which must fill packetBytes
+// exactly. Every attribute known to the client is checked against the
+// length and family required by the RFCs, so that the getters never read
+// out of bounds.
+func newPacketFromBytes(packetBytes []byte) (*packet, error) {
 	pkt := new(packet)
-	pkt.types = binary.BigEndian.Uint16(packetBytes[0:2])
-	pkt.length = binary.BigEndian.Uint16(packetBytes[2:4])
-	pkt.transID = packetBytes[4:20]
-	pkt.attributes = make([]attribute, 0, 10)
-	packetBytes = packetBytes[20:]
-	for pos := uint16(0); pos+4 < uint16(len(packetBytes)); {
-		types := binary.BigEndian.Uint16(packetBytes[pos : pos+2])
-		length := binary.BigEndian.Uint16(packetBytes[pos+2 : pos+4])
-		end := pos + 4 + length
-		if end < pos+4 || end > uint16(len(packetBytes)) {
-			return nil, errors.New("Received data format mismatch")
-		}
-		value := packetBytes[pos+4 : end]
-		attribute := newAttribute(types, value)
-		pkt.addAttribute(*attribute)
-		pos += align(length) + 4
+	if err := pkt.decode(packetBytes); err != nil {
+		return nil, err
 	}
 	return pkt, nil
 }
 
+// decode works like newPacketFromBytes, but decodes into v, reusing its
+// attributes. The transaction ID and the values reference b without
+// copying, so b must not be reused while v is.
+func (v *packet) decode(b []byte) error {
+	if len(b) < 20 {
+		return errors.New("Received data length too short")
+	}
+	if len(b) > math.MaxUint16+20 {
+		return errors.New("Received data length too long")
+	}
+	if b[0]&0xc0 != 0 {
+		return errors.New("Received data is not a STUN message")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length != len(b)-20 {
+		return fmt.Errorf("Received data length mismatch: header says %d, got %d",
+			length, len(b)-20)
+	}
+	if length%4 != 0 {
+		return fmt.Errorf("Received data length %d not a multiple of 4", length)
+	}
+	v.types = binary.BigEndian.Uint16(b[0:2])
+	v.length = 0
+	v.transID = b[4:20]
+	if v.attributes == nil {
+		v.attributes = make([]attribute, 0, 10)
+	}
+	v.attributes = v.attributes[:0]
+	v.raw = b
+	body := b[20:]
+	for pos := 0; pos < len(body); {
+		if pos+4 > len(body) {
+			return fmt.Errorf("Received data truncated: attribute header at %d", pos)
+		}
+		types := binary.BigEndian.Uint16(body[pos : pos+2])
+		length := binary.BigEndian.Uint16(body[pos+2 : pos+4])
+		end := pos + 4 + int(length)
+		if end > len(body) {
+			return fmt.Errorf("Received data truncated: attribute 0x%04x of length %d at %d",
+				types, length, pos)
+		}
+		// The value references the received bytes, so it must not
+		// be padded in place.
+		a := attribute{types, length, body[pos+4 : end]}
+		if err := a.validate(); err != nil {
+			return err
+		}
+		v.addAttribute(a)
+		pos += int(align(length)) + 4
+	}
+	return nil
+}
+
 func (v *packet) addAttribute(a attribute) {
 	v.attributes = append(v.attributes, a)
 	v.length += align(a.length) + 4
 }
 
+// encode appends the packet to b and returns the extended buffer, so that
+// a caller may encode into a buffer of its own without allocating.
+func (v *packet) encode(b []byte) []byte {
+	b = append(b, byte(v.types>>8), byte(v.types), byte(v.length>>8), byte(v.length))
+	b = append(b, v.transID...)
+	for i := range v.attributes {
+		a := &v.attributes[i]
+		b = append(b, byte(a.types>>8), byte(a.types), byte(a.length>>8), byte(a.length))
+		b = append(b, a.value...)
+		if n := int(align(a.length)) - len(a.value); n > 0 {
+			b = append(b, zeros[:n]...)
+		}
+	}
+	return b
+}
+
 func (v *packet) bytes() []byte {
-	packetBytes := make([]byte, 4)
-	binary.BigEndian.PutUint16(packetBytes[0:2], v.types)
-	binary.BigEndian.PutUint16(packetBytes[2:4], v.length)
-	packetBytes = append(packetBytes, v.transID...)
-	for _, a := range v.attributes {
-		buf := make([]byte, 2)
-		binary.BigEndian.PutUint16(buf, a.types)
-		packetBytes = append(packetBytes, buf...)
-		binary.BigEndian.PutUint16(buf, a.length)
-		packetBytes = append(packetBytes, buf...)
-		packetBytes = append(packetBytes, a.value...)
-	}
-	return packetBytes
+	return v.encode(make([]byte, 0, 20+int(v.length)))
+}
+
+// zeros pads the values of attributes.
+var zeros [4]byte
+
+// bufferPool holds the buffers which packets are encoded into before
+// being sent.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, maxPacketSize)
+		return &b
+	},
+}
+
+// packetPool holds the packets which requests are decoded into, and
+// responses built in, by the handlers of received datagrams.
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return new(packet)
+	},
+}
+
+// writePacket encodes pkt into a pooled buffer and sends it to addr.
+func writePacket(conn net.PacketConn, pkt *packet, addr net.Addr) (int, error) {
+	buf := bufferPool.Get().(*[]byte)
+	*buf = pkt.encode((*buf)[:0])
+	n, err := conn.WriteTo(*buf, addr)
+	bufferPool.Put(buf)
+	return n, err
+}
+
+// checksum returns the CRC-32 of the encoded packet. It is computed over the
+// fields of the packet, without encoding it.
+func (v *packet) checksum() uint32 {
+	buf := bufferPool.Get().(*[]byte)
+	h := append((*buf)[:0], byte(v.types>>8), byte(v.types), byte(v.length>>8), byte(v.length))
+	crc := crc32.Update(0, crc32.IEEETable, h)
+	crc = crc32.Update(crc, crc32.IEEETable, v.transID)
+	for i := range v.attributes {
+		a := &v.attributes[i]
+		h = append(h[:0], byte(a.types>>8), byte(a.types), byte(a.length>>8), byte(a.length))
+		crc = crc32.Update(crc, crc32.IEEETable, h)
+		crc = crc32.Update(crc, crc32.IEEETable, a.value)
+		if n := int(align(a.length)) - len(a.value); n > 0 {
+			crc = crc32.Update(crc, crc32.IEEETable, zeros[:n])
+		}
+	}
+	*buf = h
+	bufferPool.Put(buf)
+	return crc
+}
+
+// addFingerprint appends the FINGERPRINT attribute, which must be the last
+// attribute of the packet.
+func (v *packet) addFingerprint() {
+	// The length of the packet covered by the CRC includes FINGERPRINT.
+	v.length += 8
+	crc := v.checksum() ^ fingerprint
+	v.length -= 8
+	start := len(v.buf)
+	v.buf = append(v.buf, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	v.addValue(attributeFingerprint, start)
+}
+
+// addIntegrity appends the MESSAGE-INTEGRITY attribute computed with key,
+// which must be followed by nothing but FINGERPRINT.
+func (v *packet) addIntegrity(key []byte) {
+	buf := bufferPool.Get().(*[]byte)
+	*buf = v.encode((*buf)[:0])
+	start := len(v.buf)
+	v.buf = messageIntegrity(v.buf, *buf, key)
+	bufferPool.Put(buf)
+	v.addValue(attributeMessageIntegrity, start)
+}
+
+// checkIntegrity reports whether the packet carries a MESSAGE-INTEGRITY
+// attribute which is valid for key.
+func (v *packet) checkIntegrity(key []byte) bool {
+	b := v.raw
+	if b == nil {
+		b = v.bytes()
+	}
+	// Walk the attributes on the wire, since the HMAC covers the padding
+	// bytes as they were sent.
+	for pos := 20; pos+4 <= len(b); {
+		types := binary.BigEndian.Uint16(b[pos : pos+2])
+		length := int(binary.BigEndian.Uint16(b[pos+2 : pos+4]))
+		if types == attributeMessageIntegrity {
+			if length != 20 || pos+24 > len(b) {
+				return false
+			}
+			s := hmacPool.Get().(*hmacState)
+			ok := hmac.Equal(b[pos+4:pos+24], s.compute(b[:pos], key))
+			hmacPool.Put(s)
+			return ok
+		}
+		pos += int(align(uint16(length))) + 4
+	}
+	return false
+}
+
+// checkFingerprint reports whether the packet ends with a FINGERPRINT
+// attribute whose CRC is valid.
+func (v *packet) checkFingerprint() bool {
+	b := v.raw
+	if b == nil {
+		b = v.bytes()
+	}
+	pos := len(b) - 8
+	if pos < 20 || binary.BigEndian.Uint16(b[pos:pos+2]) != attributeFingerprint ||
+		binary.BigEndian.Uint16(b[pos+2:pos+4]) != 4 {
+		return false
+	}
+	return binary.BigEndian.Uint32(b[pos+4:]) == crc32.ChecksumIEEE(b[:pos])^fingerprint
+}
+
+func (v *packet) getAttribute(types uint16) *attribute {
+	for i := range v.attributes {
+		if v.attributes[i].types == types {
+			return &v.attributes[i]
+		}
+	}
+	return nil
+}
+
+// getErrorCode returns the code and reason phrase of the ERROR-CODE
+// attribute, or 0 if there is none.
+//
+//      0                   1                   2                   3
+//      0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |           Reserved, should be 0         |Class|     Number    |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |      Reason Phrase (variable)                                ..
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+func (v *packet) getErrorCode() (int, string) {
+	a := v.getAttribute(attributeErrorCode)
+	if a == nil || len(a.value) < 4 {
+		return 0, ""
+	}
+	return int(a.value[2]&0x07)*100 + int(a.value[3]), string(a.value[4:])
 }
 
 func (v *packet) getSourceAddr() *Host {
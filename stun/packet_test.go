@@ -15,6 +15,12 @@
 package stun
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
 	"testing"
 )
 
@@ -45,10 +51,13 @@ func TestPacketAll(t *testing.T) {
 	}
 	p.addAttribute(*newChangeReqAttribute(true, true))
 	p.addAttribute(*newSoftwareAttribute("aaa"))
-	p.addAttribute(*newFingerprintAttribute(p))
+	p.addFingerprint()
 	pkt, err := newPacketFromBytes(p.bytes())
 	if err != nil {
-		t.Errorf("newPacketFromBytes error")
+		t.Fatalf("newPacketFromBytes error: %v", err)
+	}
+	if !pkt.checkFingerprint() {
+		t.Errorf("invalid fingerprint")
 	}
 	if pkt.types != 0 {
 		t.Errorf("newPacketFromBytes error")
@@ -57,3 +66,241 @@ func TestPacketAll(t *testing.T) {
 		t.Errorf("newPacketFromBytes error")
 	}
 }
+
+func TestDecodeErrors(t *testing.T) {
+	header := func(length int) []byte {
+		b := make([]byte, 20)
+		b[1] = 0x01
+		binary.BigEndian.PutUint16(b[2:4], uint16(length))
+		binary.BigEndian.PutUint32(b[4:8], magicCookie)
+		return b
+	}
+	attr := func(types uint16, value ...byte) []byte {
+		b := make([]byte, 4, 4+len(value)+3)
+		binary.BigEndian.PutUint16(b[0:2], types)
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(value)))
+		b = append(b, value...)
+		return append(b, make([]byte, int(align(uint16(len(value))))-len(value))...)
+	}
+	message := func(attrs ...[]byte) []byte {
+		var body []byte
+		for _, a := range attrs {
+			body = append(body, a...)
+		}
+		return append(header(len(body)), body...)
+	}
+	tests := []struct {
+		name  string
+		b     []byte
+		valid bool
+	}{
+		{"empty", message(), true},
+		{"mapped address", message(attr(attributeMappedAddress, 0, 1, 0, 80, 1, 2, 3, 4)), true},
+		{"IPv6 address", message(attr(attributeXorMappedAddress, append([]byte{0, 2, 0, 80}, make([]byte, 16)...)...)), true},
+		{"unknown attribute", message(attr(0x7fff, 1, 2, 3)), true},
+		{"not STUN", append([]byte{0xc0}, message()[1:]...), false},
+		{"length too long", header(4), false},
+		{"length not aligned", append(header(2), 0, 0), false},
+		{"length mismatch", append(header(4), 0, 1), false},
+		{"truncated value", append(header(8), 0, 1, 0, 8, 0, 1, 0, 80), false},
+		{"short address", message(attr(attributeMappedAddress, 0, 1)), false},
+		{"IPv4 address of IPv6 length", message(attr(attributeMappedAddress, append([]byte{0, 1, 0, 80}, make([]byte, 16)...)...)), false},
+		{"IPv6 address of IPv4 length", message(attr(attributeXorMappedAddress, 0, 2, 0, 80, 1, 2, 3, 4)), false},
+		{"unknown family", message(attr(attributeOtherAddress, 0, 3, 0, 80, 1, 2, 3, 4)), false},
+		{"short fingerprint", message(attr(attributeFingerprint, 1, 2)), false},
+		{"short integrity", message(attr(attributeMessageIntegrity, make([]byte, 16)...)), false},
+		{"short error code", message(attr(attributeErrorCode, 0, 0)), false},
+		{"invalid error class", message(attr(attributeErrorCode, 0, 0, 7, 0)), false},
+		{"longest username", message(attr(attributeUsername, make([]byte, 512)...)), true},
+		{"long username", message(attr(attributeUsername, make([]byte, 513)...)), false},
+		{"longest software", message(attr(attributeSoftware, make([]byte, 763)...)), true},
+		{"long software", message(attr(attributeSoftware, make([]byte, 764)...)), false},
+	}
+	for _, test := range tests {
+		_, err := newPacketFromBytes(test.b)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: newPacketFromBytes error: %v", test.name, err)
+		}
+	}
+}
+
+// newBenchPacket returns a Binding response as sent by the server.
+func newBenchPacket(t testing.TB) *packet {
+	req, err := newPacket()
+	if err != nil {
+		t.Fatalf("newPacket error: %v", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("2.0.0.1"), Port: 40000}
+	p := newBindingResponse(req, addr)
+	p.addAttribute(*newRawAddrAttribute(attributeMappedAddress, addr))
+	p.addAttribute(*newSoftwareAttribute("go-stun"))
+	p.addFingerprint()
+	return p
+}
+
+func TestEncode(t *testing.T) {
+	p := newBenchPacket(t)
+	b := p.bytes()
+	if len(b) != 20+int(p.length) {
+		t.Fatalf("encoded %d bytes, want %d", len(b), 20+int(p.length))
+	}
+	if got := p.encode([]byte{1, 2}); !bytes.Equal(got[2:], b) {
+		t.Errorf("encode does not append the packet")
+	}
+	if !p.checkFingerprint() {
+		t.Errorf("invalid fingerprint")
+	}
+	p.length -= 8
+	p.attributes = p.attributes[:len(p.attributes)-1]
+	if p.checksum() != crc32.ChecksumIEEE(p.bytes()) {
+		t.Errorf("checksum differs from the CRC of the encoded packet")
+	}
+
+	var q packet
+	if err := q.decode(b); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if q.length != p.length+8 || len(q.attributes) != 4 || !bytes.Equal(q.encode(nil), b) {
+		t.Errorf("decode error: %d attributes of length %d", len(q.attributes), q.length)
+	}
+}
+
+func TestAllocations(t *testing.T) {
+	p := newBenchPacket(t)
+	b := p.bytes()
+	buf := make([]byte, 0, maxPacketSize)
+	var q packet
+	key := []byte("password")
+	funcs := map[string]func(){
+		"encode":   func() { buf = p.encode(buf[:0]) },
+		"decode":   func() { q.decode(b) },
+		"checksum": func() { p.checksum() },
+	}
+	signed, err := newPacket()
+	if err != nil {
+		t.Fatalf("newPacket error: %v", err)
+	}
+	signed.addAttribute(*newUsernameAttribute("user"))
+	signed.addIntegrity(key)
+	var r packet
+	if err := r.decode(signed.bytes()); err != nil || !r.checkIntegrity(key) {
+		t.Fatalf("invalid MESSAGE-INTEGRITY: %v", err)
+	}
+	// The integrity functions use pooled state.
+	if !raceEnabled {
+		funcs["integrity"] = func() { buf = messageIntegrity(buf[:0], b, key) }
+		funcs["check integrity"] = func() { r.checkIntegrity(key) }
+	}
+	for name, f := range funcs {
+		if n := testing.AllocsPerRun(100, f); n != 0 {
+			t.Errorf("%s allocates %v times", name, n)
+		}
+	}
+}
+
+func TestMessageIntegrity(t *testing.T) {
+	p := newBenchPacket(t)
+	legacy, err := newLegacyPacket()
+	if err != nil {
+		t.Fatalf("newLegacyPacket error: %v", err)
+	}
+	legacy.addAttribute(*newSoftwareAttribute("go-stun"))
+	for _, b := range [][]byte{p.bytes(), legacy.bytes()} {
+		for _, size := range []int{0, 16, 64, 100} {
+			key := bytes.Repeat([]byte{0xa5}, size)
+			// The reference pads and rewrites the length on a copy.
+			buf := make([]byte, len(b))
+			copy(buf, b)
+			binary.BigEndian.PutUint16(buf[2:4], uint16(len(b)-20+24))
+			if binary.BigEndian.Uint32(b[4:8]) != magicCookie {
+				buf = append(buf, make([]byte, (64-len(b)%64)%64)...)
+			}
+			mac := hmac.New(sha1.New, key)
+			mac.Write(buf)
+			if got := messageIntegrity(nil, b, key); !bytes.Equal(got, mac.Sum(nil)) {
+				t.Errorf("%d-byte key: HMAC %x, want %x", size, got, mac.Sum(nil))
+			}
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	p := newBenchPacket(b)
+	buf := make([]byte, 0, maxPacketSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = p.encode(buf[:0])
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	raw := newBenchPacket(b).bytes()
+	var p packet
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := p.decode(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFingerprint(b *testing.B) {
+	p := newBenchPacket(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.checksum()
+	}
+}
+
+func BenchmarkIntegrity(b *testing.B) {
+	raw := newBenchPacket(b).bytes()
+	key := []byte("password")
+	buf := make([]byte, 0, 20)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = messageIntegrity(buf[:0], raw, key)
+	}
+}
+
+func TestAttributeLength(t *testing.T) {
+	value := make([]byte, 3, 8)
+	value[0], value[1], value[2] = 'a', 'b', 'c'
+	value = append(value, 0xff)[:3]
+	a := newAttribute(attributeSoftware, value)
+	if a.length != 3 || !bytes.Equal(a.value, []byte{'a', 'b', 'c', 0}) {
+		t.Errorf("attribute of length %d, value %v", a.length, a.value)
+	}
+	if value[:4][3] != 0xff {
+		t.Errorf("newAttribute pads in the array of the caller")
+	}
+
+	p, err := newPacket()
+	if err != nil {
+		t.Fatalf("newPacket error: %v", err)
+	}
+	p.addAttribute(*a)
+	p.addAttribute(*newUseCandidateAttribute())
+	b := p.bytes()
+	// The length on the wire excludes the padding, but the message
+	// length includes it.
+	if p.length != 12 || len(b) != 32 || binary.BigEndian.Uint16(b[22:24]) != 3 ||
+		!bytes.Equal(b[24:28], []byte{'a', 'b', 'c', 0}) || binary.BigEndian.Uint16(b[30:32]) != 0 {
+		t.Fatalf("encoded %x", b)
+	}
+	// The decoded value excludes the padding, and references the
+	// received bytes, which are not written.
+	received := append([]byte(nil), b...)
+	q, err := newPacketFromBytes(received)
+	if err != nil {
+		t.Fatalf("newPacketFromBytes error: %v", err)
+	}
+	if s := q.getAttribute(attributeSoftware); s == nil || s.length != 3 || string(s.value) != "abc" {
+		t.Errorf("decoded attribute %v", s)
+	}
+	if u := q.getAttribute(attributeUseCandidate); u == nil || u.length != 0 || len(u.value) != 0 {
+		t.Errorf("decoded attribute %v", u)
+	}
+	if !bytes.Equal(received, b) || !bytes.Equal(q.bytes(), b) {
+		t.Errorf("decoding changed the packet")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rttBuckets are the upper bounds of the RTT histogram, in seconds.
+var rttBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// PrometheusMetrics collects the measurements of clients, and serves them in
+// the Prometheus text exposition format. It may be shared by many clients.
+type PrometheusMetrics struct {
+	mu       sync.Mutex
+	counters map[string]map[string]float64 // by metric name and labels
+	rtt      map[string]*histogram         // by labels
+}
+
+type histogram struct {
+	counts []uint64 // by bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// prometheusHelp describes the counters, in the order they are served.
+var prometheusHelp = []struct{ name, help string }{
+	{"stun_requests_sent_total", "STUN requests sent, including retransmissions."},
+	{"stun_retransmissions_total", "STUN requests retransmitted."},
+	{"stun_timeouts_total", "STUN transactions without response."},
+	{"stun_error_responses_total", "STUN error responses by code."},
+	{"stun_nat_type_total", "Results of NAT type discovery."},
+	{"stun_nat_behavior_total", "Results of NAT behavior tests."},
+}
+
+// NewPrometheusMetrics returns an empty collection of metrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	m := new(PrometheusMetrics)
+	m.counters = make(map[string]map[string]float64)
+	m.rtt = make(map[string]*histogram)
+	return m
+}
+
+func (m *PrometheusMetrics) inc(name string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]float64)
+	}
+	m.counters[name][formatLabels(labels)]++
+}
+
+// RequestSent implements Metrics.
+func (m *PrometheusMetrics) RequestSent(server string) {
+	m.inc("stun_requests_sent_total", "server", server)
+}
+
+// Retransmission implements Metrics.
+func (m *PrometheusMetrics) Retransmission(server string) {
+	m.inc("stun_retransmissions_total", "server", server)
+}
+
+// Timeout implements Metrics.
+func (m *PrometheusMetrics) Timeout(server string) {
+	m.inc("stun_timeouts_total", "server", server)
+}
+
+// ErrorResponse implements Metrics.
+func (m *PrometheusMetrics) ErrorResponse(server string, code int) {
+	m.inc("stun_error_responses_total", "server", server, "code", strconv.Itoa(code))
+}
+
+// NATType implements Metrics.
+func (m *PrometheusMetrics) NATType(t NATType) {
+	m.inc("stun_nat_type_total", "type", t.String())
+}
+
+// NATBehavior implements Metrics.
+func (m *PrometheusMetrics) NATBehavior(b *NATBehavior) {
+	m.inc("stun_nat_behavior_total", "mapping", b.MappingType.String(),
+		"filtering", b.FilteringType.String())
+}
+
+// RTT implements Metrics.
+func (m *PrometheusMetrics) RTT(server string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := formatLabels([]string{"server", server})
+	h := m.rtt[labels]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(rttBuckets))}
+		m.rtt[labels] = h
+	}
+	v := d.Seconds()
+	for i, le := range rttBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.text())
+}
+
+func (m *PrometheusMetrics) text() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b bytes.Buffer
+	for _, c := range prometheusHelp {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, labels := range sortedKeys(m.counters[c.name]) {
+			fmt.Fprintf(&b, "%s%s %s\n", c.name, labels, formatValue(m.counters[c.name][labels]))
+		}
+	}
+	const name = "stun_rtt_seconds"
+	fmt.Fprintf(&b, "# HELP %s Round-trip time of STUN transactions.\n# TYPE %s histogram\n", name, name)
+	keys := make([]string, 0, len(m.rtt))
+	for labels := range m.rtt {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		h := m.rtt[labels]
+		// Insert the bucket label into the other labels.
+		prefix := strings.TrimSuffix(labels, "}") + ","
+		cumulative := uint64(0)
+		for i, le := range rttBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "%s_bucket%sle=\"%s\"} %d\n", name, prefix, formatValue(le), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", name, labels, formatValue(h.sum))
+		fmt.Fprintf(&b, "%s_count%s %d\n", name, labels, h.count)
+	}
+	return b.Bytes()
+}
+
+// formatLabels formats alternating label names and values.
+func formatLabels(labels []string) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(labels[i] + "=\"")
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1]))
+		b.WriteString("\"")
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
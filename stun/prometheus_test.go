@@ -0,0 +1,80 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{Filtering: apd})
+	defer conn.Close()
+	m := NewPrometheusMetrics()
+	c := newTestClient(conn)
+	c.SetMetrics(m)
+	if _, _, err := c.Discover(); err != nil {
+		t.Fatalf("Discover error: %v", err)
+	}
+	m.ErrorResponse(testServerAddr, 420)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	text := string(body)
+	// Test I and the filtered Test II go to the primary address, Test I
+	// and the filtered Test III go to the other address.
+	for _, line := range []string{
+		`stun_requests_sent_total{server="1.0.0.1:3478"} 4`,
+		`stun_retransmissions_total{server="1.0.0.1:3478"} 2`,
+		`stun_timeouts_total{server="1.0.0.2:3479"} 1`,
+		`stun_error_responses_total{server="1.0.0.1:3478",code="420"} 1`,
+		`stun_nat_type_total{type="Port restricted NAT"} 1`,
+		`stun_rtt_seconds_bucket{server="1.0.0.1:3478",le="+Inf"} 1`,
+		`stun_rtt_seconds_count{server="1.0.0.1:3478"} 1`,
+		"# TYPE stun_rtt_seconds histogram",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Metrics error: %q not found in\n%s", line, text)
+		}
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Metrics error: content type %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	pkt, _ := newPacket()
+	pkt.types = typeBindingErrorResponse
+	pkt.addAttribute(*newAttribute(attributeErrorCode, append([]byte{0, 0, 4, 20}, "Unknown Attribute"...)))
+	p, err := newPacketFromBytes(pkt.bytes())
+	if err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
+	conn, err := nattest.NewNetwork().ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	resp := newResponse(p, conn, false)
+	if resp.errorCode != 420 || resp.errorReason != "Unknown Attribute" {
+		t.Errorf("Error response error: %d %q", resp.errorCode, resp.errorReason)
+	}
+}
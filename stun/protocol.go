@@ -0,0 +1,84 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"sync/atomic"
+)
+
+// Protocol is the version of STUN spoken by a client.
+type Protocol int
+
+// Protocol versions.
+const (
+	// ProtocolAuto speaks RFC 5389, and switches to RFC 3489 if the first
+	// response of the server has no XOR-MAPPED-ADDRESS.
+	ProtocolAuto Protocol = iota
+	ProtocolRFC5389
+	// ProtocolRFC3489 uses a random 128-bit transaction ID without the
+	// magic cookie, omits SOFTWARE and FINGERPRINT, and only reads
+	// MAPPED-ADDRESS and CHANGED-ADDRESS from the responses.
+	ProtocolRFC3489
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolAuto:
+		return "auto"
+	case ProtocolRFC5389:
+		return "RFC 5389"
+	case ProtocolRFC3489:
+		return "RFC 3489"
+	}
+	return "Unknown"
+}
+
+// SetProtocol sets the version of STUN spoken by the client, which is
+// ProtocolAuto by default.
+func (c *Client) SetProtocol(p Protocol) {
+	c.protocol = p
+	atomic.StoreInt32(&c.detected, int32(ProtocolAuto))
+}
+
+// Protocol returns the version of STUN spoken by the client. In the auto
+// mode, it is the version detected from the server, or ProtocolAuto if the
+// server has not answered yet.
+func (c *Client) Protocol() Protocol {
+	if c.protocol != ProtocolAuto {
+		return c.protocol
+	}
+	return Protocol(atomic.LoadInt32(&c.detected))
+}
+
+// legacy tells whether the client speaks RFC 3489.
+func (c *Client) legacy() bool {
+	return c.Protocol() == ProtocolRFC3489
+}
+
+// detectProtocol detects the version of STUN of the server from its first
+// success response, since RFC 5389 requires XOR-MAPPED-ADDRESS.
+func (c *Client) detectProtocol(p *packet) {
+	if c.protocol != ProtocolAuto || p.types != typeBindingResponse {
+		return
+	}
+	detected := ProtocolRFC5389
+	if p.getAttribute(attributeXorMappedAddress) == nil &&
+		p.getAttribute(attributeXorMappedAddressExp) == nil {
+		detected = ProtocolRFC3489
+	}
+	if atomic.CompareAndSwapInt32(&c.detected, int32(ProtocolAuto), int32(detected)) {
+		c.logger.Log(LevelDebug, "protocol detected", "protocol", detected)
+	}
+}
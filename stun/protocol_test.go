@@ -0,0 +1,60 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol Protocol
+		legacy   bool // whether the server only speaks RFC 3489
+		detected Protocol
+	}{
+		{"auto", ProtocolAuto, false, ProtocolRFC5389},
+		{"auto with legacy server", ProtocolAuto, true, ProtocolRFC3489},
+		{"legacy", ProtocolRFC3489, false, ProtocolRFC3489},
+		{"legacy with legacy server", ProtocolRFC3489, true, ProtocolRFC3489},
+	}
+	for _, test := range tests {
+		n := nattest.NewNetwork()
+		s := newTestServer(t, n)
+		s.legacy = test.legacy
+		conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{Filtering: ad})
+		c := newTestClient(conn)
+		c.SetProtocol(test.protocol)
+		nat, host, err := c.Discover()
+		if err != nil || nat != NATRestricted || host.String() != "2.0.0.1:5000" {
+			t.Errorf("%s: Discover error: %v %v %v", test.name, nat, host, err)
+		}
+		if c.Protocol() != test.detected {
+			t.Errorf("%s: Protocol error: %v, expected %v", test.name, c.Protocol(), test.detected)
+		}
+		pkt, err := c.newBindingReq(false, false)
+		if err != nil {
+			t.Fatalf("newBindingReq error: %v", err)
+		}
+		cookie := binary.BigEndian.Uint32(pkt.transID[:4]) == magicCookie
+		fingerprint := pkt.getAttribute(attributeFingerprint) != nil
+		if legacy := test.detected == ProtocolRFC3489; cookie == legacy || fingerprint == legacy {
+			t.Errorf("%s: request error: cookie %v, fingerprint %v", test.name, cookie, fingerprint)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	punchInterval     = defaultTimeout * time.Millisecond
+	punchSprayPorts   = 32
+	punchSprayRounds  = 32
+	punchFinalRequest = 3
+	// punchPendingLifetime is how long a response to our request is
+	// awaited, after which the request is forgotten.
+	punchPendingLifetime = 10 * punchInterval
+)
+
+// Peer is the remote end of hole punching. It is exchanged through a
+// signalling channel, together with the credentials which both ends share:
+// Username and Password authenticate the checks in both directions, so both
+// ends use the same values, for Punch as for ConsentManager. An ICE-lite
+// peer expects its ufrag, a colon and ours as Username, and its pwd as
+// Password.
+type Peer struct {
+	Host     *Host   // mapped address of the peer, returned by Discover
+	NAT      NATType // NAT type of the peer, returned by Discover
+	Username string
+	Password string
+}
+
+// Punch opens a path between conn and peer, where both ends call Punch at
+// about the same time. It sends Binding requests authenticated with the
+// credentials of peer and answers the ones coming from the peer, until a
+// request of each side got its response. It returns the address the peer is
+// reachable at, which differs from peer.Host if the peer is behind a
+// symmetric NAT.
+//
+// If the peer is behind a symmetric NAT, its mapping towards us is unknown.
+// Punch then probes many ports of the peer, so that the peer's probes can
+// pass our NAT once one of the ports matches, like in the birthday attack.
+func Punch(ctx context.Context, conn net.PacketConn, peer *Peer) (*Host, error) {
+	if peer == nil || peer.Host == nil {
+		return nil, errors.New("no peer address")
+	}
+	addr, err := net.ResolveUDPAddr("udp", peer.Host.TransportAddr())
+	if err != nil {
+		return nil, err
+	}
+	p := &puncher{
+		conn:    conn,
+		peer:    peer,
+		key:     []byte(peer.Password),
+		known:   make(map[string]bool),
+		pending: make(map[string]time.Time),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:     time.Now,
+	}
+	p.tieBreaker = p.rand.Uint64()
+	p.addTarget(addr)
+	defer conn.SetReadDeadline(time.Time{})
+	return p.run(ctx)
+}
+
+type puncher struct {
+	conn       net.PacketConn
+	peer       *Peer
+	key        []byte
+	targets    []*net.UDPAddr       // addresses probed every round
+	known      map[string]bool      // addresses probed at least once
+	pending    map[string]time.Time // expiry by transaction ID of our requests
+	confirmed  *net.UDPAddr         // source of the first valid response
+	nominated  bool                 // the peer has got a response as well
+	tieBreaker uint64               // of ICE-CONTROLLING in our requests
+	rounds     int
+	rand       *rand.Rand
+	now        func() time.Time
+}
+
+func (p *puncher) run(ctx context.Context) (*Host, error) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := p.probe(); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(punchInterval)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := p.conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for {
+			n, addr, err := p.conn.ReadFrom(buf)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if err := p.handle(buf[:n], addr); err != nil {
+				return nil, err
+			}
+			if p.confirmed != nil && p.nominated {
+				// The peer may still wait for our nomination, so
+				// send it a few more times without waiting for the
+				// responses.
+				for i := 0; i < punchFinalRequest; i++ {
+					if err := p.send(p.confirmed, true); err != nil {
+						return nil, err
+					}
+				}
+				return newHostFromUDPAddr(p.confirmed), nil
+			}
+		}
+	}
+}
+
+// probe sends a round of requests. Once a response arrived, it only probes
+// the confirmed address, and tells the peer so by USE-CANDIDATE.
+func (p *puncher) probe() error {
+	// Forget the requests which are not answered in time, so that
+	// spraying ports does not grow pending forever.
+	now := p.now()
+	for id, expires := range p.pending {
+		if !now.Before(expires) {
+			delete(p.pending, id)
+		}
+	}
+	if p.confirmed != nil {
+		return p.send(p.confirmed, true)
+	}
+	for _, addr := range p.targets {
+		if err := p.send(addr, false); err != nil {
+			return err
+		}
+	}
+	if p.peer.NAT != NATSymmetric || p.rounds >= punchSprayRounds {
+		p.rounds++
+		return nil
+	}
+	// Half of the ports follow the mapped port of the peer, which catches
+	// NATs allocating ports sequentially, and the others are random.
+	base := p.targets[0]
+	for i := 0; i < punchSprayPorts; i++ {
+		port := int(p.peer.Host.Port()) + p.rounds*punchSprayPorts/2 + i + 1
+		if i >= punchSprayPorts/2 {
+			port = 1024 + p.rand.Intn(65536-1024)
+		}
+		if port > 65535 {
+			continue
+		}
+		addr := &net.UDPAddr{IP: base.IP, Port: port}
+		if p.known[addr.String()] {
+			continue
+		}
+		p.known[addr.String()] = true
+		if err := p.send(addr, false); err != nil {
+			return err
+		}
+	}
+	p.rounds++
+	return nil
+}
+
+func (p *puncher) addTarget(addr *net.UDPAddr) {
+	for _, t := range p.targets {
+		if t.String() == addr.String() {
+			return
+		}
+	}
+	p.known[addr.String()] = true
+	p.targets = append(p.targets, addr)
+}
+
+func (p *puncher) send(addr *net.UDPAddr, nominate bool) error {
+	pkt, err := newCheckRequest(p.peer, nominate, p.tieBreaker)
+	if err != nil {
+		return err
+	}
+	p.pending[string(pkt.transID)] = p.now().Add(punchPendingLifetime)
+	_, err = writePacket(p.conn, pkt, addr)
+	return err
+}
+
+// newCheckRequest returns a connectivity check of RFC 8445 authenticated
+// with the credentials of peer, which nominates the path if nominate is set.
+// The check has the PRIORITY of a peer reflexive candidate, which the peer
+// learns us as, and takes the controlling role with tieBreaker, as ICE-lite
+// peers require.
+func newCheckRequest(peer *Peer, nominate bool, tieBreaker uint64) (*packet, error) {
+	pkt, err := newPacket()
+	if err != nil {
+		return nil, err
+	}
+	pkt.types = typeBindingRequest
+	pkt.addAttribute(*newUsernameAttribute(peer.Username))
+	pkt.addAttribute(*newPriorityAttribute(candidatePriority(CandidatePeerReflexive, 65535, 1)))
+	pkt.addAttribute(*newIceControllingAttribute(tieBreaker))
+	if nominate {
+		pkt.addAttribute(*newUseCandidateAttribute())
+	}
+	pkt.addIntegrity([]byte(peer.Password))
+	pkt.addFingerprint()
+	return pkt, nil
+}
+
+func (p *puncher) handle(b []byte, addr net.Addr) error {
+	pkt, err := newPacketFromBytes(b)
+	if err != nil {
+		// Not a STUN packet, which is not for us.
+		return nil
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return nil
+	}
+	switch pkt.types {
+	case typeBindingRequest:
+		if ok, err := answerCheck(p.conn, p.peer.Username, p.key, pkt, udpAddr); !ok || err != nil {
+			return err
+		}
+		// The request may come from a mapping we do not know yet,
+		// which is a peer reflexive address.
+		p.addTarget(udpAddr)
+		if pkt.getAttribute(attributeUseCandidate) != nil {
+			p.nominated = true
+		}
+	case typeBindingResponse:
+		if _, ok := p.pending[string(pkt.transID)]; !ok || !pkt.checkIntegrity(p.key) {
+			return nil
+		}
+		delete(p.pending, string(pkt.transID))
+		if p.confirmed == nil {
+			p.confirmed = udpAddr
+		}
+	}
+	return nil
+}
+
+// answerCheck answers the check req received from addr, if it carries
+// username and is authenticated with key, and tells whether it did.
+func answerCheck(conn net.PacketConn, username string, key []byte, req *packet, addr *net.UDPAddr) (bool, error) {
+	name := req.getAttribute(attributeUsername)
+	if name == nil || string(name.value) != username || !req.checkIntegrity(key) {
+		return false, nil
+	}
+	resp := newBindingResponse(req, addr)
+	resp.addIntegrity(key)
+	resp.addFingerprint()
+	_, err := writePacket(conn, resp, addr)
+	return true, err
+}
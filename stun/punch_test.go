@@ -0,0 +1,175 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+// punchPair runs Punch on both ends at the same time and returns the
+// addresses each end confirmed.
+func punchPair(ctx context.Context, a, b net.PacketConn, peerOfA, peerOfB *Peer) (*Host, *Host, error, error) {
+	type result struct {
+		host *Host
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		host, err := Punch(ctx, b, peerOfB)
+		ch <- result{host, err}
+	}()
+	hostA, errA := Punch(ctx, a, peerOfA)
+	r := <-ch
+	return hostA, r.host, errA, r.err
+}
+
+func listenLoopback(t *testing.T) net.PacketConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	return conn
+}
+
+func TestPunchLoopback(t *testing.T) {
+	a := listenLoopback(t)
+	defer a.Close()
+	b := listenLoopback(t)
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hostA, hostB, errA, errB := punchPair(ctx, a, b,
+		&Peer{newHostFromStr(b.LocalAddr().String()), NATNone, "user", "pass"},
+		&Peer{newHostFromStr(a.LocalAddr().String()), NATNone, "user", "pass"})
+	if errA != nil || errB != nil {
+		t.Fatalf("Punch error: %v, %v", errA, errB)
+	}
+	if hostA.String() != b.LocalAddr().String() || hostB.String() != a.LocalAddr().String() {
+		t.Errorf("Punch error: get %v and %v", hostA, hostB)
+	}
+}
+
+func TestPunchWrongPassword(t *testing.T) {
+	a := listenLoopback(t)
+	defer a.Close()
+	b := listenLoopback(t)
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, _, errA, errB := punchPair(ctx, a, b,
+		&Peer{newHostFromStr(b.LocalAddr().String()), NATNone, "user", "pass"},
+		&Peer{newHostFromStr(a.LocalAddr().String()), NATNone, "user", "wrong"})
+	if errA != context.DeadlineExceeded || errB != context.DeadlineExceeded {
+		t.Errorf("Punch error: expected deadline exceeded, get %v, %v", errA, errB)
+	}
+}
+
+func TestPunchNAT(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     nattest.Config
+		natA     NATType
+		natB     NATType
+		punchedA bool // whether b reaches a at another port than its mapped one
+	}{
+		{"port restricted", nattest.Config{Filtering: apd}, nattest.Config{Filtering: apd},
+			NATPortRestricted, NATPortRestricted, false},
+		{"symmetric to port restricted",
+			nattest.Config{Mapping: apd, Filtering: apd, PortAllocation: nattest.PortSequential},
+			nattest.Config{Filtering: apd}, NATSymmetric, NATPortRestricted, true},
+	}
+	for _, test := range tests {
+		n := nattest.NewNetwork()
+		newTestServer(t, n)
+		a := listenBehindNAT(t, n, "2.0.0.1", test.a)
+		b := listenBehindNAT(t, n, "2.0.0.2", test.b)
+		hostA, err := newTestClient(a).Keepalive()
+		if err != nil {
+			t.Fatalf("%s: Keepalive error: %v", test.name, err)
+		}
+		hostB, err := newTestClient(b).Keepalive()
+		if err != nil {
+			t.Fatalf("%s: Keepalive error: %v", test.name, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		gotB, gotA, errA, errB := punchPair(ctx, a, b,
+			&Peer{hostB, test.natB, "user", "pass"},
+			&Peer{hostA, test.natA, "user", "pass"})
+		cancel()
+		if errA != nil || errB != nil {
+			t.Fatalf("%s: Punch error: %v, %v", test.name, errA, errB)
+		}
+		if gotB.String() != hostB.String() {
+			t.Errorf("%s: Punch error: expected %v, get %v", test.name, hostB, gotB)
+		}
+		if (gotA.String() != hostA.String()) != test.punchedA {
+			t.Errorf("%s: Punch error: mapped %v, get %v", test.name, hostA, gotA)
+		}
+	}
+}
+
+func TestPunchPending(t *testing.T) {
+	clock := time.Unix(0, 0)
+	peer := &Peer{newHostFromStr("2.0.0.1:5000"), NATSymmetric, "user", "pass"}
+	p := &puncher{
+		conn:    discardConn{addr: &net.UDPAddr{IP: net.ParseIP("1.0.0.1"), Port: 5000}},
+		peer:    peer,
+		key:     []byte(peer.Password),
+		known:   make(map[string]bool),
+		pending: make(map[string]time.Time),
+		rand:    rand.New(rand.NewSource(1)),
+		now:     func() time.Time { return clock },
+	}
+	p.addTarget(&net.UDPAddr{IP: net.ParseIP("2.0.0.1"), Port: 5000})
+	// Spraying ports sends many requests a round, but only the ones of
+	// the last rounds are awaited.
+	limit := int(punchPendingLifetime/punchInterval) * (1 + punchSprayPorts)
+	for i := 0; i < 2*punchSprayRounds; i++ {
+		if err := p.probe(); err != nil {
+			t.Fatalf("probe error: %v", err)
+		}
+		if len(p.pending) > limit {
+			t.Fatalf("%d requests pending after %d rounds", len(p.pending), i+1)
+		}
+		clock = clock.Add(punchInterval)
+	}
+	// Once spraying ends, only the target is probed.
+	if n := int(punchPendingLifetime / punchInterval); len(p.pending) != n {
+		t.Errorf("%d requests pending after spraying, want %d", len(p.pending), n)
+	}
+
+	// An answered request is forgotten, so that a replayed response is
+	// dropped.
+	var id string
+	for id = range p.pending {
+	}
+	req := &packet{types: typeBindingRequest, transID: []byte(id)}
+	resp := newBindingResponse(req, &net.UDPAddr{IP: net.ParseIP("1.0.0.1"), Port: 5000})
+	resp.addIntegrity(p.key)
+	resp.addFingerprint()
+	from := &net.UDPAddr{IP: net.ParseIP("2.0.0.1"), Port: 5000}
+	if err := p.handle(resp.bytes(), from); err != nil {
+		t.Fatalf("handle error: %v", err)
+	}
+	if _, ok := p.pending[id]; ok || p.confirmed == nil || p.confirmed.String() != from.String() {
+		t.Errorf("confirmed %v, answered request pending %v", p.confirmed, ok)
+	}
+}
@@ -15,26 +15,37 @@
 package stun
 
 import (
-	"fmt"
 	"net"
+	"time"
 )
 
 type response struct {
-	packet      *packet // the original packet from the server
-	serverAddr  *Host   // the address received packet
-	changedAddr *Host   // parsed from packet
-	mappedAddr  *Host   // parsed from packet, external addr of client NAT
-	otherAddr   *Host   // parsed from packet, to replace changedAddr in RFC 5780
-	identical   bool    // if mappedAddr is in local addr list
+	packet      *packet       // the original packet from the server
+	serverAddr  *Host         // the address received packet
+	changedAddr *Host         // parsed from packet
+	mappedAddr  *Host         // parsed from packet, external addr of client NAT
+	otherAddr   *Host         // parsed from packet, to replace changedAddr in RFC 5780
+	sourceAddr  *Host         // parsed from packet, the address the server sent it from
+	reflected   *Host         // parsed from packet, the address of the redirected request
+	identical   bool          // if mappedAddr is in local addr list
+	attempts    int           // number of requests sent
+	rtt         time.Duration // time since the last request was sent
+	errorCode   int           // parsed from packet, 0 for a success response
+	errorReason string
 }
 
-func newResponse(pkt *packet, conn net.PacketConn) *response {
-	resp := &response{pkt, nil, nil, nil, nil, false}
+// newResponse parses the response received on conn. A response of RFC 3489,
+// if legacy, has no XOR-MAPPED-ADDRESS and OTHER-ADDRESS.
+func newResponse(pkt *packet, conn net.PacketConn, legacy bool) *response {
+	resp := &response{packet: pkt}
 	if pkt == nil {
 		return resp
 	}
 	// RFC 3489 doesn't require the server return XOR mapped address.
-	mappedAddr := pkt.getXorMappedAddr()
+	var mappedAddr *Host
+	if !legacy {
+		mappedAddr = pkt.getXorMappedAddr()
+	}
 	if mappedAddr == nil {
 		mappedAddr = pkt.getMappedAddr()
 	}
@@ -53,24 +64,14 @@ func newResponse(pkt *packet, conn net.PacketConn) *response {
 	}
 	// compute otherAddr
 	otherAddr := pkt.getOtherAddr()
-	if otherAddr != nil {
+	if otherAddr != nil && !legacy {
 		otherAddrHost := newHostFromStr(otherAddr.String())
 		resp.otherAddr = otherAddrHost
 	}
-
-	return resp
-}
-
-// String is only used for verbose mode output.
-func (r *response) String() string {
-	if r == nil {
-		return "Nil"
+	resp.sourceAddr = pkt.getSourceAddr()
+	resp.reflected = pkt.getRawAddr(attributeReflectedFrom)
+	if pkt.types&0x0110 == 0x0110 {
+		resp.errorCode, resp.errorReason = pkt.getErrorCode()
 	}
-	return fmt.Sprintf("{packet nil: %v, local: %v, remote: %v, changed: %v, other: %v, identical: %v}",
-		r.packet == nil,
-		r.mappedAddr,
-		r.serverAddr,
-		r.changedAddr,
-		r.otherAddr,
-		r.identical)
+	return resp
 }
@@ -0,0 +1,43 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"time"
+)
+
+// TestResult records a test performed in the discover process.
+type TestResult struct {
+	Name        string // "Test I", "Test II" or "Test III" of RFC 3489
+	Dest        *Host  // the address the requests were sent to
+	ChangeIP    bool   // CHANGE-REQUEST flags of the requests
+	ChangePort  bool
+	Attempts    int           // number of requests sent
+	RTT         time.Duration // time between the last request and the response
+	Responded   bool
+	ServerAddr  *Host // the address the response came from
+	MappedAddr  *Host
+	OtherAddr   *Host
+	ChangedAddr *Host
+}
+
+// DiscoveryResult is the result of the discover process, together with the
+// tests which lead to it.
+type DiscoveryResult struct {
+	NAT    NATType
+	Host   *Host  // mapped address of the client, nil if unknown
+	Reason string // why the NAT type was chosen, empty on error
+	Tests  []TestResult
+}
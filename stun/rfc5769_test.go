@@ -0,0 +1,196 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// The test vectors of RFC 5769. The padding of some values is made of
+// spaces rather than zeros, which MESSAGE-INTEGRITY and FINGERPRINT cover.
+const (
+	// Section 2.1, a Binding request with short-term credentials.
+	rfc5769Request = `
+		00 01 00 58 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+		80 22 00 10 53 54 55 4e 20 74 65 73 74 20 63 6c 69 65 6e 74
+		00 24 00 04 6e 00 01 ff
+		80 29 00 08 93 2f f9 b1 51 26 3b 36
+		00 06 00 09 65 76 74 6a 3a 68 36 76 59 20 20 20
+		00 08 00 14 9a ea a7 0c bf d8 cb 56 78 1e f2 b5 b2 d3 f2 49 c1 b5 71 a2
+		80 28 00 04 e5 7a 3b cf`
+
+	// Section 2.2, a Binding response with an IPv4 address.
+	rfc5769ResponseIPv4 = `
+		01 01 00 3c 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+		80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+		00 20 00 08 00 01 a1 47 e1 12 a6 43
+		00 08 00 14 2b 91 f5 99 fd 9e 90 c3 8c 74 89 f9 2a f9 ba 53 f0 6b e7 d7
+		80 28 00 04 c0 7d 4c 96`
+
+	// Section 2.3, a Binding response with an IPv6 address.
+	rfc5769ResponseIPv6 = `
+		01 01 00 48 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+		80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+		00 20 00 14 00 02 a1 47 01 13 a9 fa a5 d3 f1 79 bc 25 f4 b5 be d2 b9 d9
+		00 08 00 14 a3 82 95 4e 4b e6 7b f1 17 84 c9 7c 82 92 c2 75 bf e3 ed 41
+		80 28 00 04 c8 fb 0b 4c`
+
+	// Section 2.4, a Binding request with long-term credentials.
+	rfc5769LongTerm = `
+		00 01 00 60 21 12 a4 42 78 ad 34 33 c6 ad 72 c0 29 da 41 2e
+		00 06 00 12 e3 83 9e e3 83 88 e3 83 aa e3 83 83 e3 82 af e3 82 b9 00 00
+		00 15 00 1c 66 2f 2f 34 39 39 6b 39 35 34 64 36 4f 4c 33 34 6f 4c 39 46 53 54 76 79 36 34 73 41
+		00 14 00 0b 65 78 61 6d 70 6c 65 2e 6f 72 67 00
+		00 08 00 14 f6 70 24 65 6d d6 4a 3e 02 b8 e0 71 2e 85 c9 a2 8c a8 96 66`
+
+	rfc5769Password = "VOkJxbRl1RmTxUk/WvJxBt"
+)
+
+func decodeVector(t *testing.T, vector string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(vector), ""))
+	if err != nil {
+		t.Fatalf("invalid vector: %v", err)
+	}
+	return b
+}
+
+// checkVector checks that the vector decodes, that its MESSAGE-INTEGRITY
+// and FINGERPRINT are valid, and that pkt, built from the decoded fields,
+// encodes to the vector.
+func checkVector(t *testing.T, name string, b []byte, key []byte, fingerprinted bool, build func(*packet) *packet) *packet {
+	p, err := newPacketFromBytes(b)
+	if err != nil {
+		t.Fatalf("%s: newPacketFromBytes error: %v", name, err)
+	}
+	if !p.checkIntegrity(key) {
+		t.Errorf("%s: MESSAGE-INTEGRITY not reproduced", name)
+	}
+	if p.checkIntegrity([]byte("wrong")) {
+		t.Errorf("%s: MESSAGE-INTEGRITY valid for a wrong key", name)
+	}
+	if p.checkFingerprint() != fingerprinted {
+		t.Errorf("%s: checkFingerprint is %v", name, !fingerprinted)
+	}
+	pkt := build(p)
+	pkt.addIntegrity(key)
+	if fingerprinted {
+		pkt.addFingerprint()
+	}
+	if got := pkt.bytes(); !bytes.Equal(got, b) {
+		t.Errorf("%s: encoded\n%s\nwant\n%s", name, hex.Dump(got), hex.Dump(b))
+	}
+	return p
+}
+
+// spaced returns an attribute whose value is padded with spaces.
+func spaced(types uint16, value string) attribute {
+	a := *newAttribute(types, []byte(value))
+	a.value = append([]byte(value), "   "[:len(a.value)-len(value)]...)
+	return a
+}
+
+func TestRFC5769Request(t *testing.T) {
+	b := decodeVector(t, rfc5769Request)
+	p := checkVector(t, "request", b, []byte(rfc5769Password), true, func(p *packet) *packet {
+		pkt := &packet{types: typeBindingRequest, transID: p.transID}
+		pkt.addAttribute(*newSoftwareAttribute("STUN test client"))
+		pkt.addAttribute(*newAttribute(attributePriority, []byte{0x6e, 0x00, 0x01, 0xff}))
+		pkt.addAttribute(*newAttribute(attributeIceControlled, []byte{0x93, 0x2f, 0xf9, 0xb1, 0x51, 0x26, 0x3b, 0x36}))
+		pkt.addAttribute(spaced(attributeUsername, "evtj:h6vY"))
+		return pkt
+	})
+	if p.types != typeBindingRequest || p.legacy() {
+		t.Errorf("type 0x%04x", p.types)
+	}
+	if a := p.getAttribute(attributeSoftware); a == nil || string(a.value) != "STUN test client" {
+		t.Errorf("SOFTWARE %v", a)
+	}
+	if a := p.getAttribute(attributePriority); a == nil || binary.BigEndian.Uint32(a.value) != 0x6e0001ff {
+		t.Errorf("PRIORITY %v", a)
+	}
+	if a := p.getAttribute(attributeIceControlled); a == nil || binary.BigEndian.Uint64(a.value) != 0x932ff9b151263b36 {
+		t.Errorf("ICE-CONTROLLED %v", a)
+	}
+	if a := p.getAttribute(attributeUsername); a == nil || string(a.value) != "evtj:h6vY" {
+		t.Errorf("USERNAME %v", a)
+	}
+}
+
+func TestRFC5769Response(t *testing.T) {
+	tests := []struct {
+		name   string
+		vector string
+		ip     string
+		xor    string // the value of XOR-MAPPED-ADDRESS
+	}{
+		{"IPv4 response", rfc5769ResponseIPv4, "192.0.2.1", "0001a147e112a643"},
+		{"IPv6 response", rfc5769ResponseIPv6, "2001:db8:1234:5678:11:2233:4455:6677",
+			"0002a1470113a9faa5d3f179bc25f4b5bed2b9d9"},
+	}
+	for _, test := range tests {
+		addr := &net.UDPAddr{IP: net.ParseIP(test.ip), Port: 32853}
+		b := decodeVector(t, test.vector)
+		p := checkVector(t, test.name, b, []byte(rfc5769Password), true, func(p *packet) *packet {
+			pkt := &packet{types: typeBindingResponse, transID: p.transID}
+			pkt.addAttribute(spaced(attributeSoftware, "test vector"))
+			pkt.addAttribute(*newXorAddrAttribute(attributeXorMappedAddress, addr, p.transID))
+			return pkt
+		})
+		if a := p.getAttribute(attributeSoftware); a == nil || string(a.value) != "test vector" {
+			t.Errorf("%s: SOFTWARE %v", test.name, a)
+		}
+		if h := p.getXorMappedAddr(); h == nil || h.IP() != addr.IP.String() || h.Port() != 32853 {
+			t.Errorf("%s: XOR-MAPPED-ADDRESS %v", test.name, h)
+		}
+		a := newXorAddrAttribute(attributeXorMappedAddress, addr, p.transID)
+		if got := hex.EncodeToString(a.value); got != test.xor {
+			t.Errorf("%s: XOR-MAPPED-ADDRESS encoded to %s, want %s", test.name, got, test.xor)
+		}
+	}
+}
+
+func TestRFC5769LongTerm(t *testing.T) {
+	const (
+		username = "マトリックス"
+		nonce    = "f//499k954d6OL34oL9FSTvy64sA"
+		realm    = "example.org"
+		// The password "TheªMºtrⅨ" after SASLprep.
+		password = "TheMatrIX"
+	)
+	key := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	b := decodeVector(t, rfc5769LongTerm)
+	p := checkVector(t, "long-term request", b, key[:], false, func(p *packet) *packet {
+		pkt := &packet{types: typeBindingRequest, transID: p.transID}
+		pkt.addAttribute(*newUsernameAttribute(username))
+		pkt.addAttribute(*newAttribute(attributeNonce, []byte(nonce)))
+		pkt.addAttribute(*newAttribute(attributeRealm, []byte(realm)))
+		return pkt
+	})
+	for types, want := range map[uint16]string{
+		attributeUsername: username,
+		attributeNonce:    nonce,
+		attributeRealm:    realm,
+	} {
+		if a := p.getAttribute(types); a == nil || string(a.value) != want {
+			t.Errorf("attribute 0x%04x is %v, want %q", types, a, want)
+		}
+	}
+}
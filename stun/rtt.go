@@ -0,0 +1,184 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// RTTStats is the round-trip time estimate of a server, smoothed as in
+// RFC 6298. Following Karn's algorithm, responses to retransmitted requests
+// are not sampled, since it is unknown which request they answer.
+//
+// The retransmission timeout of a transaction starts from RTO, if it is more
+// than the default of 100ms, and doubles on every retransmission as before.
+// This avoids spurious retransmissions on paths of high latency.
+type RTTStats struct {
+	SRTT    time.Duration // smoothed round-trip time
+	RTTVar  time.Duration // round-trip time variation
+	RTO     time.Duration // initial retransmission timeout of the next request
+	Samples int
+}
+
+// rttTable holds the round-trip time estimates by server address.
+type rttTable struct {
+	mu    sync.Mutex
+	stats map[string]*RTTStats
+}
+
+// sample updates the estimate of server with the round-trip time r.
+func (t *rttTable) sample(server string, r time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stats == nil {
+		t.stats = make(map[string]*RTTStats)
+	}
+	s := t.stats[server]
+	if s == nil {
+		s = &RTTStats{SRTT: r, RTTVar: r / 2}
+		t.stats[server] = s
+	} else {
+		diff := s.SRTT - r
+		if diff < 0 {
+			diff = -diff
+		}
+		s.RTTVar = (3*s.RTTVar + diff) / 4
+		s.SRTT = (7*s.SRTT + r) / 8
+	}
+	s.Samples++
+	s.RTO = clampRTO(s.SRTT + 4*s.RTTVar)
+}
+
+// rto returns the initial retransmission timeout of server, which is at
+// least min.
+func (t *rttTable) rto(server string, min time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.stats[server]; s != nil && s.RTO > min {
+		return s.RTO
+	}
+	return min
+}
+
+func (t *rttTable) get(server string) (RTTStats, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.stats[server]; s != nil {
+		return *s, true
+	}
+	return RTTStats{}, false
+}
+
+func clampRTO(d time.Duration) time.Duration {
+	if max := maxTimeout * time.Millisecond; d > max {
+		return max
+	}
+	return d
+}
+
+// RTT returns the round-trip time estimate of the server at address, which is
+// resolved as in SetServerAddr, and false if no response has been sampled.
+func (c *Client) RTT(address string) (RTTStats, bool) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return RTTStats{}, false
+	}
+	return c.rtt.get(addr.String())
+}
+
+// PingStats is the result of Ping.
+type PingStats struct {
+	Sent     int
+	Received int
+	Loss     float64 // ratio of the requests without response
+	Min      time.Duration
+	Avg      time.Duration
+	Max      time.Duration
+	Jitter   time.Duration   // mean difference between consecutive round-trip times
+	RTTs     []time.Duration // round-trip times, 0 for the lost requests
+}
+
+// Ping sends n Binding requests to the STUN server, one every interval, and
+// measures their round-trip times. A request is not retransmitted, and is
+// lost if its response does not arrive within 1.6s.
+func (c *Client) Ping(n int, interval time.Duration) (*PingStats, error) {
+	if n <= 0 {
+		return nil, errors.New("invalid number of requests")
+	}
+	serverUDPAddr, err := c.resolveServer()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.connection(serverUDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	if conn != c.conn {
+		defer conn.Close()
+	}
+	timeout := time.Duration(c.timeout*maxTimeout/defaultTimeout) * time.Millisecond
+	stats := new(PingStats)
+	var last time.Duration
+	var sum, jitter time.Duration
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		pkt, err := c.newBindingReq(false, false)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.transact(context.Background(), pkt, conn, conn, serverUDPAddr, 1, timeout)
+		if err != nil {
+			return nil, err
+		}
+		stats.Sent++
+		var rtt time.Duration
+		if resp != nil {
+			rtt = resp.rtt
+			if stats.Received == 0 || rtt < stats.Min {
+				stats.Min = rtt
+			}
+			if rtt > stats.Max {
+				stats.Max = rtt
+			}
+			if stats.Received > 0 {
+				if d := rtt - last; d < 0 {
+					jitter -= d
+				} else {
+					jitter += d
+				}
+			}
+			stats.Received++
+			sum += rtt
+			last = rtt
+		}
+		stats.RTTs = append(stats.RTTs, rtt)
+		c.logger.Log(LevelInfo, "ping", "seq", i+1, "rtt", rtt, "lost", resp == nil)
+		if i < n-1 {
+			time.Sleep(interval - time.Since(start))
+		}
+	}
+	stats.Loss = float64(stats.Sent-stats.Received) / float64(stats.Sent)
+	if stats.Received > 0 {
+		stats.Avg = sum / time.Duration(stats.Received)
+	}
+	if stats.Received > 1 {
+		stats.Jitter = jitter / time.Duration(stats.Received-1)
+	}
+	return stats, nil
+}
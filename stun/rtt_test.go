@@ -0,0 +1,78 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestRTTTable(t *testing.T) {
+	var table rttTable
+	table.sample("s", 200*time.Millisecond)
+	s, _ := table.get("s")
+	if s.SRTT != 200*time.Millisecond || s.RTTVar != 100*time.Millisecond || s.RTO != 600*time.Millisecond {
+		t.Errorf("RTT error: first sample gives %+v", s)
+	}
+	table.sample("s", 100*time.Millisecond)
+	s, _ = table.get("s")
+	// RTTVAR = 3/4*100 + 1/4*|200-100|, SRTT = 7/8*200 + 1/8*100.
+	if s.SRTT != 187500*time.Microsecond || s.RTTVar != 100*time.Millisecond || s.Samples != 2 {
+		t.Errorf("RTT error: second sample gives %+v", s)
+	}
+	if d := table.rto("s", time.Second); d != time.Second {
+		t.Errorf("RTO error: %v, expected the minimum 1s", d)
+	}
+	if d := table.rto("other", 100*time.Millisecond); d != 100*time.Millisecond {
+		t.Errorf("RTO error: %v without estimate", d)
+	}
+	table.sample("slow", 10*time.Second)
+	if s, _ := table.get("slow"); s.RTO != maxTimeout*time.Millisecond {
+		t.Errorf("RTO error: %v, expected the maximum", s.RTO)
+	}
+}
+
+func TestPing(t *testing.T) {
+	n := nattest.NewNetwork()
+	n.SetSeed(1)
+	newTestServer(t, n)
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{LossRate: 0.3})
+	defer conn.Close()
+	c := newTestClient(conn)
+	stats, err := c.Ping(20, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Ping error: %v", err)
+	}
+	if stats.Sent != 20 || len(stats.RTTs) != 20 {
+		t.Fatalf("Ping error: %d sent, %d RTTs", stats.Sent, len(stats.RTTs))
+	}
+	if stats.Received == 0 || stats.Received == 20 {
+		t.Errorf("Ping error: %d received, expected some lost", stats.Received)
+	}
+	if loss := float64(20-stats.Received) / 20; stats.Loss != loss {
+		t.Errorf("Ping error: loss %v, expected %v", stats.Loss, loss)
+	}
+	if stats.Min > stats.Avg || stats.Avg > stats.Max {
+		t.Errorf("Ping error: min %v, avg %v, max %v", stats.Min, stats.Avg, stats.Max)
+	}
+	if _, ok := c.RTT(testServerAddr); !ok {
+		t.Errorf("RTT error: no estimate after ping")
+	}
+	if _, err := c.Ping(0, time.Millisecond); err == nil {
+		t.Errorf("Ping error: expected error for no request")
+	}
+}
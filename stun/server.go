@@ -0,0 +1,269 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server is a STUN server, which answers Binding requests as required by
+// RFC 3489 and RFC 5780. It honours CHANGE-REQUEST, RESPONSE-PORT and, for
+// requests authenticated with a shared secret, RESPONSE-ADDRESS. A response
+// sent to a RESPONSE-ADDRESS carries REFLECTED-FROM, the address of the
+// request, so that the receiver can trace who asked for it. A request without
+// the magic cookie is answered as in RFC 3489, without the attributes of
+// RFC 5389 and RFC 5780.
+type Server struct {
+	conns        [2][2]net.PacketConn // by IP and port
+	softwareName string
+	mu           sync.Mutex
+	passwords    map[string]credential // by username, handed out by Shared Secret responses
+	now          func() time.Time      // the clock of the credentials, which tests replace
+	publicIPs    [2]net.IP             // advertised IPs of conns[0] and conns[1]
+}
+
+// NewServer returns a server on conns, where conns[i][j] listens on the i-th
+// IP and the j-th port. Only conns[0][0] is required. Without the others, the
+// server has no alternate address, and answers CHANGE-REQUEST with the error
+// 420 as RFC 5780 requires.
+func NewServer(conns [2][2]net.PacketConn) *Server {
+	s := new(Server)
+	s.conns = conns
+	s.passwords = make(map[string]credential)
+	s.now = time.Now
+	s.SetSoftwareName(DefaultSoftwareName)
+	return s
+}
+
+// SetSoftwareName sets the SOFTWARE attribute of the responses.
+func (s *Server) SetSoftwareName(name string) {
+	s.softwareName = name
+}
+
+// SetPublicIPs sets the IPs the server advertises in SOURCE-ADDRESS,
+// RESPONSE-ORIGIN, CHANGED-ADDRESS and OTHER-ADDRESS for the sockets on the
+// first and the second IP, which is needed behind a 1:1 NAT. By default,
+// the IPs are the ones the sockets are bound to. The attributes are omitted
+// for a socket bound to the wildcard address without a public IP, since the
+// address the request came to is unknown.
+func (s *Server) SetPublicIPs(primary, alternate net.IP) {
+	s.publicIPs = [2]net.IP{primary, alternate}
+}
+
+// addr returns the advertised address of conns[i][j], and false if it is
+// unknown.
+func (s *Server) addr(i, j int) (net.UDPAddr, bool) {
+	if s.conns[i][j] == nil {
+		return net.UDPAddr{}, false
+	}
+	local, ok := s.conns[i][j].LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return net.UDPAddr{}, false
+	}
+	ip := s.publicIPs[i]
+	if ip == nil {
+		ip = local.IP
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return net.UDPAddr{}, false
+	}
+	return net.UDPAddr{IP: ip, Port: local.Port}, true
+}
+
+// Serve answers requests until the sockets are closed.
+func (s *Server) Serve() error {
+	if s.conns[0][0] == nil {
+		return errors.New("no primary address")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			if s.conns[i][j] == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(i, j int) {
+				defer wg.Done()
+				s.serve(i, j)
+			}(i, j)
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// Close closes the sockets of the server.
+func (s *Server) Close() error {
+	var err error
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			if s.conns[i][j] == nil {
+				continue
+			}
+			if e := s.conns[i][j].Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// alternate tells whether the server listens on every address.
+func (s *Server) alternate() bool {
+	return s.conns[0][1] != nil && s.conns[1][0] != nil && s.conns[1][1] != nil
+}
+
+func (s *Server) serve(i, j int) {
+	buf := make([]byte, maxPacketSize)
+	req, resp := new(packet), new(packet)
+	for {
+		n, addr, err := s.conns[i][j].ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// The request is decoded in place, and is done with before the
+		// next read.
+		if err := req.decode(buf[:n]); err != nil || req.types != typeBindingRequest {
+			continue
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ci, cj, to := s.handle(req, resp, from, i, j)
+		writePacket(s.conns[ci][cj], resp, to)
+	}
+}
+
+// handle builds in resp the response to req received from from on
+// conns[i][j], and returns the socket to send it through and its
+// destination. Answering an ordinary request does not allocate.
+func (s *Server) handle(req, resp *packet, from *net.UDPAddr, i, j int) (int, int, *net.UDPAddr) {
+	key, code := s.authenticate(req)
+	if code != 0 {
+		resp.respondError(req, code, errorReasons[code])
+		return i, j, from
+	}
+	// RFC 3489 section 12.2: a response sent to any RESPONSE-ADDRESS
+	// would make the server reflect, and amplify, floods towards third
+	// parties, so it is only honoured for authenticated requests.
+	if req.getAttribute(attributeResponseAddress) != nil && key == nil {
+		resp.respondError(req, errorUnauthorized, errorReasons[errorUnauthorized])
+		return i, j, from
+	}
+	ci, cj := i, j
+	if a := req.getAttribute(attributeChangeRequest); a != nil && len(a.value) == 4 {
+		if a.value[3]&0x06 != 0 && !s.alternate() {
+			resp.respondError(req, errorUnknownAttribute, "Unknown Attribute")
+			start := len(resp.buf)
+			resp.buf = append(resp.buf, 0, attributeChangeRequest)
+			resp.addValue(attributeUnknownAttributes, start)
+			return i, j, from
+		}
+		if a.value[3]&0x04 != 0 {
+			ci = 1 - i
+		}
+		if a.value[3]&0x02 != 0 {
+			cj = 1 - j
+		}
+	}
+	legacy := req.legacy()
+	resp.respond(req, typeBindingResponse)
+	if !legacy {
+		resp.addXorAddr(attributeXorMappedAddress, from)
+	}
+	resp.addRawAddr(attributeMappedAddress, from)
+	origin, ok := s.addr(ci, cj)
+	if ok {
+		resp.addRawAddr(attributeSourceAddress, &origin)
+	}
+	if other, ok := s.addr(1-i, 1-j); s.alternate() && ok {
+		resp.addRawAddr(attributeChangedAddress, &other)
+		if !legacy {
+			resp.addRawAddr(attributeOtherAddress, &other)
+		}
+	}
+	if !legacy && ok {
+		resp.addRawAddr(attributeResponseOrigin, &origin)
+	}
+	to := from
+	if a := req.getAttribute(attributeResponseAddress); a != nil {
+		if h := a.rawAddr(); h != nil {
+			to = &net.UDPAddr{IP: net.ParseIP(h.IP()), Port: int(h.Port())}
+			resp.addRawAddr(attributeReflectedFrom, from)
+		}
+	}
+	if legacy {
+		if key != nil {
+			resp.addIntegrity(key)
+		}
+		return ci, cj, to
+	}
+	if a := req.getAttribute(attributeResponsePort); a != nil && len(a.value) == 4 {
+		to = &net.UDPAddr{IP: to.IP, Port: int(binary.BigEndian.Uint16(a.value))}
+	}
+	resp.addString(attributeSoftware, s.softwareName)
+	if key != nil {
+		resp.addIntegrity(key)
+	}
+	resp.addFingerprint()
+	return ci, cj, to
+}
+
+// errorReasons are the reason phrases of the errors the server and the
+// ICE-lite agent return.
+var errorReasons = map[int]string{
+	errorBadRequest:            "Bad Request",
+	errorUnauthorized:          "Unauthorized",
+	errorStaleCredentials:      "Stale Credentials",
+	errorIntegrityCheckFailure: "Integrity Check Failure",
+	errorMissingUsername:       "Missing Username",
+	errorRoleConflict:          "Role Conflict",
+}
+
+// authenticate checks the USERNAME and MESSAGE-INTEGRITY of req, as in
+// RFC 3489. It returns the key of the response, which is nil if req is not
+// authenticated, or the code of the error to return.
+func (s *Server) authenticate(req *packet) ([]byte, int) {
+	username := req.getAttribute(attributeUsername)
+	integrity := req.getAttribute(attributeMessageIntegrity)
+	switch {
+	case username == nil && integrity == nil:
+		return nil, 0
+	case username == nil:
+		return nil, errorMissingUsername
+	case integrity == nil:
+		return nil, errorUnauthorized
+	}
+	now := s.now()
+	s.mu.Lock()
+	c, ok := s.passwords[string(username.value)]
+	if ok && !now.Before(c.expires) {
+		delete(s.passwords, string(username.value))
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, errorStaleCredentials
+	}
+	if !req.checkIntegrity(c.key) {
+		return nil, errorIntegrityCheckFailure
+	}
+	return c.key, 0
+}
@@ -0,0 +1,381 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+const testServerAddr = "1.0.0.1:3478"
+
+// testServer is a server whose sockets misbehave on demand, to test how the
+// client copes with broken servers.
+type testServer struct {
+	*Server
+	noOtherAddr  bool  // omit CHANGED-ADDRESS and OTHER-ADDRESS
+	ignoreChange bool  // always answer from the address the request came to
+	silent       int32 // drop all responses while nonzero, set atomically
+	legacy       bool  // answer every request as in RFC 3489
+	deafOther    bool  // drop the requests to the alternate IP and port
+}
+
+// newTestServer returns a server on two IPs and two ports of a virtual
+// network, which is closed at the end of the test.
+func newTestServer(t *testing.T, n *nattest.Network) *testServer {
+	s := new(testServer)
+	var conns [2][2]net.PacketConn
+	for i, ip := range []string{"1.0.0.1", "1.0.0.2"} {
+		for j, port := range []int{3478, 3479} {
+			conn, err := n.ListenPacket(ip, port)
+			if err != nil {
+				t.Fatalf("ListenPacket error: %v", err)
+			}
+			conns[i][j] = brokenConn{conn, s, i == 1 && j == 1}
+		}
+	}
+	s.Server = NewServer(conns)
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// brokenConn is a socket of a testServer, which rewrites the requests and
+// responses as the misbehaviors of the server require. The responses it
+// rewrites lose MESSAGE-INTEGRITY.
+type brokenConn struct {
+	net.PacketConn
+	s     *testServer
+	other bool // on the alternate IP and port
+}
+
+func (c brokenConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	for err == nil && c.other && c.s.deafOther {
+		n, addr, err = c.PacketConn.ReadFrom(b)
+	}
+	if err != nil || n < 20 {
+		return n, addr, err
+	}
+	if c.s.legacy && binary.BigEndian.Uint32(b[4:8]) == magicCookie {
+		// The server takes the request for one of RFC 3489, and
+		// WriteTo puts the magic cookie back into the response.
+		binary.BigEndian.PutUint32(b[4:8], 0)
+	}
+	for pos := 20; c.s.ignoreChange && pos+4 <= n; {
+		types := binary.BigEndian.Uint16(b[pos : pos+2])
+		length := int(binary.BigEndian.Uint16(b[pos+2 : pos+4]))
+		if types == attributeChangeRequest && length == 4 && pos+8 <= n {
+			b[pos+7] &^= 0x06
+		}
+		pos += int(align(uint16(length))) + 4
+	}
+	return n, addr, err
+}
+
+func (c brokenConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&c.s.silent) != 0 {
+		return len(b), nil
+	}
+	if c.s.legacy && len(b) >= 20 && binary.BigEndian.Uint32(b[4:8]) == 0 {
+		binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	}
+	if !c.s.noOtherAddr {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	var resp packet
+	if err := resp.decode(b); err != nil {
+		return 0, err
+	}
+	p := &packet{types: resp.types, transID: resp.transID}
+	for _, a := range resp.attributes {
+		switch a.types {
+		case attributeChangedAddress, attributeOtherAddress, attributeMessageIntegrity, attributeFingerprint:
+		default:
+			p.addAttribute(a)
+		}
+	}
+	if resp.getAttribute(attributeFingerprint) != nil {
+		p.addFingerprint()
+	}
+	if _, err := c.PacketConn.WriteTo(p.bytes(), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// newTestClient returns a client on conn which talks to the test server and
+// gives up quickly, since the virtual network has no latency.
+func newTestClient(conn net.PacketConn) *Client {
+	c := NewClientWithConnection(conn)
+	c.SetServerAddr(testServerAddr)
+	c.timeout = 10
+	c.numRetransmit = 3
+	return c
+}
+
+// listenBehindNAT returns a socket behind a new NAT with the given public IP.
+func listenBehindNAT(t *testing.T, n *nattest.Network, publicIP string, config nattest.Config) net.PacketConn {
+	nat, err := n.NewNAT(publicIP, config)
+	if err != nil {
+		t.Fatalf("NewNAT error: %v", err)
+	}
+	conn, err := nat.ListenPacket("10.0.0.2", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	return conn
+}
+
+func TestResponseAddress(t *testing.T) {
+	n := nattest.NewNetwork()
+	s := newTestServer(t, n)
+	nat, err := n.NewNAT("2.0.0.1", nattest.Config{Filtering: ad})
+	if err != nil {
+		t.Fatalf("NewNAT error: %v", err)
+	}
+	conn, err := nat.ListenPacket("10.0.0.2", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	in, err := nat.ListenPacket("10.0.0.2", 5001)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	c := newTestClient(conn)
+	server, _ := c.resolveServer()
+	target := &net.UDPAddr{IP: net.ParseIP("4.0.0.1"), Port: 80}
+	// Without a shared secret, the server refuses to send elsewhere.
+	pkt, err := c.newBindingReq(false, false, *newRawAddrAttribute(attributeResponseAddress, target))
+	if err != nil {
+		t.Fatalf("newBindingReq error: %v", err)
+	}
+	resp, err := c.send(pkt, conn, server)
+	if err != nil || resp == nil || resp.errorCode != errorUnauthorized {
+		t.Errorf("unauthenticated RESPONSE-ADDRESS error: %+v %v", resp, err)
+	}
+
+	s.mu.Lock()
+	s.passwords["user"] = credential{[]byte("password"), time.Now().Add(time.Minute)}
+	s.mu.Unlock()
+	c.username, c.password = "user", []byte("password")
+	reflected, err := c.ResponseAddressTest(in)
+	if err != nil || reflected.String() != "2.0.0.1:5000" {
+		t.Errorf("ResponseAddressTest error: %v %v", reflected, err)
+	}
+}
+
+func TestServerWithoutAlternate(t *testing.T) {
+	n := nattest.NewNetwork()
+	primary, err := n.ListenPacket("1.0.0.1", 3478)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	s := NewServer([2][2]net.PacketConn{{primary}})
+	go s.Serve()
+	defer s.Close()
+	conn, err := n.ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	c := newTestClient(conn)
+	server, _ := c.resolveServer()
+	resp, err := c.test1(conn, server)
+	if err != nil || resp == nil || resp.mappedAddr.String() != "3.0.0.1:5000" ||
+		resp.sourceAddr.String() != testServerAddr || resp.changedAddr != nil {
+		t.Fatalf("Binding error: %+v %v", resp, err)
+	}
+	resp, err = c.sendBindingReq(conn, server, false, true)
+	if err != nil || resp == nil || resp.errorCode != errorUnknownAttribute {
+		t.Errorf("CHANGE-REQUEST error: %+v %v", resp, err)
+	}
+}
+
+func TestSourceAddressMismatch(t *testing.T) {
+	n := nattest.NewNetwork()
+	server, err := n.ListenPacket("1.0.0.1", 3478)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			size, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := newPacketFromBytes(buf[:size])
+			if err != nil {
+				continue
+			}
+			from := addr.(*net.UDPAddr)
+			resp := newBindingResponse(req, from)
+			resp.addAttribute(*newRawAddrAttribute(attributeSourceAddress,
+				&net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 3478}))
+			server.WriteTo(resp.bytes(), from)
+		}
+	}()
+	conn, err := n.ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	// A server behind a NAT may report its private address, which only
+	// the strict mode rejects.
+	c := newTestClient(conn)
+	if host, err := c.Keepalive(); err != nil || host.String() != "3.0.0.1:5000" {
+		t.Errorf("Keepalive error: %v %v", host, err)
+	}
+	c.SetStrict(true)
+	if _, err := c.Keepalive(); err == nil {
+		t.Errorf("Keepalive error: no error on SOURCE-ADDRESS mismatch")
+	}
+}
+
+// wildcardConn is a socket of the virtual network which reports the wildcard
+// address, as a socket bound to it does.
+type wildcardConn struct {
+	net.PacketConn
+}
+
+func (c wildcardConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero, Port: c.PacketConn.LocalAddr().(*net.UDPAddr).Port}
+}
+
+func TestServerWildcard(t *testing.T) {
+	// A real socket bound to the wildcard address answers on loopback,
+	// without SOURCE-ADDRESS unless a public IP is set.
+	for _, public := range []net.IP{nil, net.IPv4(127, 0, 0, 1)} {
+		conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		s := NewServer([2][2]net.PacketConn{{conn}})
+		s.SetPublicIPs(public, nil)
+		go s.Serve()
+		server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+		client := listenLoopback(t)
+		c := newTestClient(client)
+		c.SetServerAddr(server.String())
+		c.SetStrict(true)
+		if host, err := c.Keepalive(); err != nil || host.String() != client.LocalAddr().String() {
+			t.Errorf("public IP %v: Keepalive error: %v %v", public, host, err)
+		}
+		resp, err := c.test1(client, server)
+		if err != nil || resp == nil {
+			t.Fatalf("public IP %v: Binding error: %v", public, err)
+		}
+		if public == nil && resp.sourceAddr != nil || public != nil && (resp.sourceAddr == nil || resp.sourceAddr.String() != server.String()) {
+			t.Errorf("public IP %v: SOURCE-ADDRESS %v", public, resp.sourceAddr)
+		}
+		client.Close()
+		s.Close()
+	}
+
+	// Behind a 1:1 NAT, the server advertises its public IPs, which
+	// Discover relies on.
+	n := nattest.NewNetwork()
+	var conns [2][2]net.PacketConn
+	for i, ip := range []string{"1.0.0.1", "1.0.0.2"} {
+		for j, port := range []int{3478, 3479} {
+			conn, err := n.ListenPacket(ip, port)
+			if err != nil {
+				t.Fatalf("ListenPacket error: %v", err)
+			}
+			conns[i][j] = wildcardConn{conn}
+		}
+	}
+	s := NewServer(conns)
+	s.SetPublicIPs(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	go s.Serve()
+	defer s.Close()
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+	defer conn.Close()
+	c := newTestClient(conn)
+	c.SetStrict(true)
+	if nat, host, err := c.Discover(); err != nil || nat != NATFull || host.IP() != "2.0.0.1" {
+		t.Errorf("Discover error: %v %v %v", nat, host, err)
+	}
+}
+
+// newBenchRequest returns a Binding request as decoded by the server, which
+// is authenticated if key is set.
+func newBenchRequest(t testing.TB, key []byte) *packet {
+	req, err := newPacket()
+	if err != nil {
+		t.Fatalf("newPacket error: %v", err)
+	}
+	req.types = typeBindingRequest
+	req.addAttribute(*newSoftwareAttribute("go-stun"))
+	if key != nil {
+		req.addAttribute(*newUsernameAttribute("user"))
+		req.addIntegrity(key)
+	}
+	req.addFingerprint()
+	decoded, err := newPacketFromBytes(req.bytes())
+	if err != nil {
+		t.Fatalf("newPacketFromBytes error: %v", err)
+	}
+	return decoded
+}
+
+func TestServerAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	s := newTestServer(t, nattest.NewNetwork())
+	s.mu.Lock()
+	s.passwords["user"] = credential{[]byte("password"), time.Now().Add(time.Minute)}
+	s.mu.Unlock()
+	from := &net.UDPAddr{IP: net.ParseIP("3.0.0.1"), Port: 5000}
+	resp := new(packet)
+	for _, key := range [][]byte{nil, []byte("password")} {
+		req := newBenchRequest(t, key)
+		if n := testing.AllocsPerRun(100, func() { s.handle(req, resp, from, 0, 0) }); n != 0 {
+			t.Errorf("authenticated %v: handle allocates %v times", key != nil, n)
+		}
+		if resp.types != typeBindingResponse || !resp.checkFingerprint() {
+			t.Errorf("authenticated %v: response 0x%04x", key != nil, resp.types)
+		}
+	}
+}
+
+func BenchmarkServerHandle(b *testing.B) {
+	n := nattest.NewNetwork()
+	var conns [2][2]net.PacketConn
+	for i, ip := range []string{"1.0.0.1", "1.0.0.2"} {
+		for j, port := range []int{3478, 3479} {
+			conn, err := n.ListenPacket(ip, port)
+			if err != nil {
+				b.Fatalf("ListenPacket error: %v", err)
+			}
+			defer conn.Close()
+			conns[i][j] = conn
+		}
+	}
+	s := NewServer(conns)
+	req := newBenchRequest(b, nil)
+	resp := new(packet)
+	from := &net.UDPAddr{IP: net.ParseIP("3.0.0.1"), Port: 5000}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.handle(req, resp, from, 0, 0)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ObtainSharedSecret gets a USERNAME and PASSWORD from the server with the
+// Shared Secret request of RFC 3489, sent over TLS to the TCP port of the
+// server address. The following Binding requests of the client carry the
+// USERNAME and MESSAGE-INTEGRITY computed with the PASSWORD, and responses
+// without a valid MESSAGE-INTEGRITY are rejected. The server name of config
+// defaults to the host of the server address. Servers forget the shared
+// secret after about 10 minutes, so it should be called again before, which
+// is safe while other requests are pending.
+func (c *Client) ObtainSharedSecret(config *tls.Config) error {
+	addr := c.serverAddr
+	if addr == "" {
+		addr = DefaultServerAddr
+	}
+	if config == nil {
+		config = new(tls.Config)
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	raw, err := c.dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	conn := tls.Client(raw, config)
+	defer conn.Close()
+	// Give up after about as long as a Binding transaction of RFC 3489.
+	conn.SetDeadline(time.Now().Add(time.Duration(c.timeout) * 95 * time.Millisecond))
+
+	var req *packet
+	if c.legacy() {
+		req, err = newLegacyPacket()
+	} else {
+		req, err = newPacket()
+	}
+	if err != nil {
+		return err
+	}
+	req.types = typeSharedSecretRequest
+	c.logger.Log(LevelDebug, "shared secret request", "to", addr)
+	if _, err := conn.Write(req.bytes()); err != nil {
+		return err
+	}
+	resp, err := readMessage(conn)
+	if err != nil {
+		return err
+	}
+	if string(resp.transID) != string(req.transID) {
+		return errors.New("Server error: transaction ID mismatch")
+	}
+	if resp.types == typeSharedErrorResponse {
+		code, reason := resp.getErrorCode()
+		return fmt.Errorf("Server error: shared secret error %d %s", code, reason)
+	}
+	username := resp.getAttribute(attributeUsername)
+	password := resp.getAttribute(attributePassword)
+	if resp.types != typeSharedSecretResponse || username == nil || password == nil {
+		return errors.New("Server error: no shared secret")
+	}
+	c.secretMu.Lock()
+	c.username = string(username.value)
+	c.password = append([]byte(nil), password.value...)
+	c.secretMu.Unlock()
+	c.logger.Log(LevelInfo, "shared secret obtained", "username", string(username.value))
+	return nil
+}
+
+// credentials returns the USERNAME and the key of the shared secret, which
+// is nil without one.
+func (c *Client) credentials() (string, []byte) {
+	c.secretMu.Lock()
+	defer c.secretMu.Unlock()
+	return c.username, c.password
+}
+
+// readMessage reads a STUN message from a stream.
+func readMessage(r io.Reader) (*packet, error) {
+	b := make([]byte, 20)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	b = append(b, make([]byte, binary.BigEndian.Uint16(b[2:4]))...)
+	if _, err := io.ReadFull(r, b[20:]); err != nil {
+		return nil, err
+	}
+	return newPacketFromBytes(b)
+}
+
+// ServeSharedSecret answers the Shared Secret requests of RFC 3489 on l,
+// which should be a TLS listener, until it is closed. The credentials handed
+// out authenticate the Binding requests of the server.
+func (s *Server) ServeSharedSecret(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveSharedSecret(conn)
+	}
+}
+
+// Shared secrets of RFC 3489 section 9.2, which the server forgets after
+// their lifetime, and of which it keeps a bounded number.
+const (
+	sharedSecretLifetime = 10 * time.Minute
+	maxSharedSecrets     = 10000
+)
+
+// credential is a shared secret handed out by the server.
+type credential struct {
+	key     []byte
+	expires time.Time
+}
+
+func (s *Server) serveSharedSecret(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	req, err := readMessage(conn)
+	if err != nil || req.types != typeSharedSecretRequest {
+		return
+	}
+	credentials := make([]byte, 32)
+	if _, err := rand.Read(credentials); err != nil {
+		return
+	}
+	username := hex.EncodeToString(credentials[:16])
+	password := hex.EncodeToString(credentials[16:])
+	if !s.addCredential(username, []byte(password)) {
+		resp := newErrorResponse(req, errorServerError, "Server Error")
+		resp.types = typeSharedErrorResponse
+		conn.Write(resp.bytes())
+		return
+	}
+	resp := &packet{types: typeSharedSecretResponse, transID: req.transID}
+	resp.addAttribute(*newUsernameAttribute(username))
+	resp.addAttribute(*newAttribute(attributePassword, []byte(password)))
+	conn.Write(resp.bytes())
+}
+
+// addCredential keeps the password of username for its lifetime. It drops
+// the expired credentials when there are too many, and tells whether there
+// is room for the new one.
+func (s *Server) addCredential(username string, password []byte) bool {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.passwords) >= maxSharedSecrets {
+		for name, c := range s.passwords {
+			if !now.Before(c.expires) {
+				delete(s.passwords, name)
+			}
+		}
+		if len(s.passwords) >= maxSharedSecrets {
+			return false
+		}
+	}
+	s.passwords[username] = credential{password, now.Add(sharedSecretLifetime)}
+	return true
+}
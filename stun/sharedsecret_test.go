@@ -0,0 +1,185 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+// newTLSConfigs returns the configs of a server with a self-signed
+// certificate and of a client which trusts it.
+func newTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "1.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("1.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate error: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestSharedSecret(t *testing.T) {
+	serverConfig, clientConfig := newTLSConfigs(t)
+	for _, protocol := range []Protocol{ProtocolRFC5389, ProtocolRFC3489} {
+		n := nattest.NewNetwork()
+		s := newTestServer(t, n)
+		// The virtual network has no TCP, so TLS runs on the loopback.
+		l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+		if err != nil {
+			t.Fatalf("Listen error: %v", err)
+		}
+		defer l.Close()
+		go s.ServeSharedSecret(l)
+
+		conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+		c := newTestClient(conn)
+		c.SetProtocol(protocol)
+		c.dial = func(network, address string) (net.Conn, error) {
+			return net.Dial(network, l.Addr().String())
+		}
+		if err := c.ObtainSharedSecret(clientConfig); err != nil {
+			t.Fatalf("%v: ObtainSharedSecret error: %v", protocol, err)
+		}
+		nat, host, err := c.Discover()
+		if err != nil || nat != NATFull || host.String() != "2.0.0.1:5000" {
+			t.Errorf("%v: Discover error: %v %v %v", protocol, nat, host, err)
+		}
+		c.password = []byte("wrong")
+		if _, err := c.Keepalive(); err == nil {
+			t.Errorf("%v: Keepalive error: no error with a wrong password", protocol)
+		}
+	}
+}
+
+func TestSharedSecretUntrusted(t *testing.T) {
+	serverConfig, _ := newTLSConfigs(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	defer l.Close()
+	go NewServer([2][2]net.PacketConn{}).ServeSharedSecret(l)
+	c := newTestClient(nil)
+	c.dial = func(network, address string) (net.Conn, error) {
+		return net.Dial(network, l.Addr().String())
+	}
+	if err := c.ObtainSharedSecret(nil); err == nil || c.password != nil {
+		t.Errorf("ObtainSharedSecret error: untrusted certificate accepted")
+	}
+}
+
+func TestSharedSecretExpiry(t *testing.T) {
+	serverConfig, clientConfig := newTLSConfigs(t)
+	n := nattest.NewNetwork()
+	s := newTestServer(t, n)
+	var elapsed int64 // set atomically
+	s.now = func() time.Time {
+		return time.Now().Add(time.Duration(atomic.LoadInt64(&elapsed)))
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	defer l.Close()
+	go s.ServeSharedSecret(l)
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+	c := newTestClient(conn)
+	c.dial = func(network, address string) (net.Conn, error) {
+		return net.Dial(network, l.Addr().String())
+	}
+	if err := c.ObtainSharedSecret(clientConfig); err != nil {
+		t.Fatalf("ObtainSharedSecret error: %v", err)
+	}
+	// Renewing the shared secret races with no request.
+	done := make(chan error)
+	go func() {
+		_, err := c.Keepalive()
+		done <- err
+	}()
+	if err := c.ObtainSharedSecret(clientConfig); err != nil {
+		t.Fatalf("ObtainSharedSecret error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Keepalive error: %v", err)
+	}
+
+	atomic.StoreInt64(&elapsed, int64(sharedSecretLifetime))
+	if _, err := c.Keepalive(); err == nil {
+		t.Errorf("Keepalive error: no error with an expired shared secret")
+	}
+	if err := c.ObtainSharedSecret(clientConfig); err != nil {
+		t.Fatalf("ObtainSharedSecret error: %v", err)
+	}
+	if _, err := c.Keepalive(); err != nil {
+		t.Errorf("Keepalive error: %v", err)
+	}
+
+	// The server keeps a bounded number of shared secrets, and makes room
+	// by dropping the expired ones.
+	expires := s.now().Add(time.Minute)
+	s.mu.Lock()
+	s.passwords = make(map[string]credential)
+	for i := 0; i < maxSharedSecrets; i++ {
+		s.passwords[strconv.Itoa(i)] = credential{[]byte("password"), expires}
+	}
+	s.mu.Unlock()
+	if err := c.ObtainSharedSecret(clientConfig); err == nil {
+		t.Errorf("ObtainSharedSecret error: no error with too many shared secrets")
+	}
+	atomic.StoreInt64(&elapsed, int64(sharedSecretLifetime+time.Minute))
+	if err := c.ObtainSharedSecret(clientConfig); err != nil {
+		t.Fatalf("ObtainSharedSecret error: %v", err)
+	}
+	s.mu.Lock()
+	kept := len(s.passwords)
+	s.mu.Unlock()
+	if kept != 1 {
+		t.Errorf("%d shared secrets kept", kept)
+	}
+}
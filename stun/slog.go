@@ -0,0 +1,38 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+// +build go1.21
+
+package stun
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns an EventLogger which logs through l. Trace events are
+// logged at slog.LevelDebug-4, so they are dropped unless the handler enables
+// that level.
+func NewSlogLogger(l *slog.Logger) EventLogger {
+	return slogLogger{l}
+}
+
+func (s slogLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	s.l.Log(context.Background(), slog.Level(level), msg, keyvals...)
+}
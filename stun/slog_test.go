@@ -0,0 +1,59 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+// +build go1.21
+
+package stun
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestSlogLogger(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+	for _, level := range []slog.Level{slog.LevelDebug, slog.Level(LevelTrace)} {
+		var buf bytes.Buffer
+		c := newTestClient(conn)
+		c.SetLogger(NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))))
+		if _, _, err := c.Discover(); err != nil {
+			t.Fatalf("Discover error: %v", err)
+		}
+		events := make(map[string]int)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var e map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("Log error: %v in %q", err, line)
+			}
+			events[e["msg"].(string)]++
+			if e["msg"] == "packet sent" && !strings.Contains(e["hex"].(string), "|") {
+				t.Errorf("Log error: no hex dump in %q", line)
+			}
+		}
+		if events["test started"] != 2 || events["response received"] != 2 || events["classification"] != 1 {
+			t.Errorf("Log error: get events %v", events)
+		}
+		if (events["packet sent"] > 0) != (level == slog.Level(LevelTrace)) {
+			t.Errorf("Log error: get events %v at level %v", events, level)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SetStrict sets whether the client checks the responses as RFC 5389
+// section 7.3 requires. In the strict mode, a response of another method, or
+// from an address other than the one the request was sent to, is dropped as
+// if it were never received, so that a spoofed response cannot take the
+// place of the real one. The source of the response to CHANGE-REQUEST must
+// differ in the IP and port as requested. A response whose SOURCE-ADDRESS of
+// RFC 3489 is not its source fails the request, and so does a response
+// carrying comprehension-required attributes unknown to the client, with an
+// UnknownAttributesError.
+func (c *Client) SetStrict(strict bool) {
+	c.strict = strict
+}
+
+// UnknownAttributesError is returned in the strict mode for a response
+// with comprehension-required attributes the client does not understand.
+type UnknownAttributesError struct {
+	Types []uint16
+}
+
+func (e *UnknownAttributesError) Error() string {
+	types := make([]string, len(e.Types))
+	for i, t := range e.Types {
+		types[i] = fmt.Sprintf("0x%04x", t)
+	}
+	return "Server error: unknown comprehension-required attributes " + strings.Join(types, ", ")
+}
+
+// comprehended are the comprehension-required attributes of RFC 3489,
+// RFC 5389, RFC 5780 and ICE, which the client understands.
+var comprehended = map[uint16]bool{
+	attributeMappedAddress:     true,
+	attributeResponseAddress:   true,
+	attributeChangeRequest:     true,
+	attributeSourceAddress:     true,
+	attributeChangedAddress:    true,
+	attributeUsername:          true,
+	attributePassword:          true,
+	attributeMessageIntegrity:  true,
+	attributeErrorCode:         true,
+	attributeUnknownAttributes: true,
+	attributeReflectedFrom:     true,
+	attributeRealm:             true,
+	attributeNonce:             true,
+	attributeXorMappedAddress:  true,
+	attributePriority:          true,
+	attributeUseCandidate:      true,
+	attributePadding:           true,
+	attributeResponsePort:      true,
+}
+
+// unknownRequired returns the types of the comprehension-required
+// attributes, which are below 0x8000, the client does not understand.
+func (v *packet) unknownRequired() []uint16 {
+	var types []uint16
+	for _, a := range v.attributes {
+		if a.types < 0x8000 && !comprehended[a.types] {
+			types = append(types, a.types)
+		}
+	}
+	return types
+}
+
+// accept tells whether resp, received from from, may answer req sent to to.
+func (c *Client) accept(req, resp *packet, to, from net.Addr) bool {
+	// The method is the type without the class bits.
+	if resp.types&^0x0110 != req.types&^0x0110 {
+		c.logger.Log(LevelWarn, "response dropped", "from", from, "reason", "method")
+		return false
+	}
+	var changeIP, changePort bool
+	if a := req.getAttribute(attributeChangeRequest); a != nil && len(a.value) == 4 {
+		changeIP = a.value[3]&0x04 != 0
+		changePort = a.value[3]&0x02 != 0
+	}
+	src := newHostFromStr(from.String())
+	dst, err := net.ResolveUDPAddr("udp", to.String())
+	if src == nil || err != nil || !addrCompare(src, dst, changeIP, changePort) {
+		c.logger.Log(LevelWarn, "response dropped", "from", from, "reason", "source address")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestStrict(t *testing.T) {
+	spoofed := &net.UDPAddr{IP: net.ParseIP("6.6.6.6"), Port: 6666}
+	tests := []struct {
+		name string
+		// answer answers req through server, or the spoofer of an
+		// attacker who sees the request.
+		answer func(req *packet, from *net.UDPAddr, server, spoofer net.PacketConn)
+		// the mapped address in the strict mode and not, or "" if the
+		// request fails
+		strict, loose string
+	}{
+		{"spoofed response first", func(req *packet, from *net.UDPAddr, server, spoofer net.PacketConn) {
+			spoofer.WriteTo(newBindingResponse(req, spoofed).bytes(), from)
+			server.WriteTo(newBindingResponse(req, from).bytes(), from)
+		}, "3.0.0.1:5000", "6.6.6.6:6666"},
+		{"other method", func(req *packet, from *net.UDPAddr, server, spoofer net.PacketConn) {
+			resp := newBindingResponse(req, from)
+			resp.types = typeSharedSecretResponse
+			server.WriteTo(resp.bytes(), from)
+		}, "", "3.0.0.1:5000"},
+		{"unknown attributes", func(req *packet, from *net.UDPAddr, server, spoofer net.PacketConn) {
+			resp := newBindingResponse(req, from)
+			resp.addAttribute(*newAttribute(0x7777, []byte{1}))
+			resp.addAttribute(*newAttribute(attributeChannelNumber, []byte{0, 1, 0, 0}))
+			resp.addAttribute(*newAttribute(0x8777, []byte{1}))
+			server.WriteTo(resp.bytes(), from)
+		}, "", "3.0.0.1:5000"},
+	}
+	for _, test := range tests {
+		for _, strict := range []bool{true, false} {
+			n := nattest.NewNetwork()
+			server, err := n.ListenPacket("1.0.0.1", 3478)
+			if err != nil {
+				t.Fatalf("ListenPacket error: %v", err)
+			}
+			spoofer, err := n.ListenPacket(spoofed.IP.String(), spoofed.Port)
+			if err != nil {
+				t.Fatalf("ListenPacket error: %v", err)
+			}
+			go func(answer func(*packet, *net.UDPAddr, net.PacketConn, net.PacketConn)) {
+				buf := make([]byte, maxPacketSize)
+				for {
+					size, addr, err := server.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					if req, err := newPacketFromBytes(buf[:size]); err == nil {
+						answer(req, addr.(*net.UDPAddr), server, spoofer)
+					}
+				}
+			}(test.answer)
+			conn, err := n.ListenPacket("3.0.0.1", 5000)
+			if err != nil {
+				t.Fatalf("ListenPacket error: %v", err)
+			}
+			c := newTestClient(conn)
+			c.SetStrict(strict)
+			want := test.loose
+			if strict {
+				want = test.strict
+			}
+			host, err := c.Keepalive()
+			switch {
+			case want != "" && (err != nil || host.String() != want):
+				t.Errorf("%s, strict %v: Keepalive is %v %v, want %s", test.name, strict, host, err, want)
+			case want == "" && err == nil:
+				t.Errorf("%s, strict %v: Keepalive is %v, want an error", test.name, strict, host)
+			}
+			if test.name == "unknown attributes" && strict {
+				e, ok := err.(*UnknownAttributesError)
+				if !ok || len(e.Types) != 2 || e.Types[0] != 0x7777 || e.Types[1] != attributeChannelNumber {
+					t.Errorf("%s: error %v", test.name, err)
+				}
+			}
+			server.Close()
+			spoofer.Close()
+			conn.Close()
+		}
+	}
+}
+
+func TestStrictDiscover(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn := listenBehindNAT(t, n, "2.0.0.1", nattest.Config{})
+	defer conn.Close()
+	c := newTestClient(conn)
+	c.SetStrict(true)
+	// The responses to CHANGE-REQUEST come from the alternate addresses.
+	if nat, host, err := c.Discover(); err != nil || nat != NATFull || host.IP() != "2.0.0.1" {
+		t.Errorf("Discover error: %v %v %v", nat, host, err)
+	}
+}
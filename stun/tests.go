@@ -19,22 +19,35 @@ import (
 	"net"
 )
 
+// ErrBlocked is returned by BehaviorTest if the STUN server does not respond.
+var ErrBlocked = errors.New("NAT blocked")
+
 func (c *Client) sendWithLog(conn net.PacketConn, addr *net.UDPAddr, changeIP bool, changePort bool) (*response, error) {
-	c.logger.Debugln("Send To:", addr)
 	resp, err := c.sendBindingReq(conn, addr, changeIP, changePort)
 	if err != nil {
 		return nil, err
 	}
-	c.logger.Debugln("Received:", resp)
 	if resp == nil && !changeIP && !changePort {
-		return nil, errors.New("NAT blocked")
+		return nil, ErrBlocked
 	}
 	if resp != nil && !addrCompare(resp.serverAddr, addr, changeIP, changePort) {
 		return nil, errors.New("Server error: response IP/port")
 	}
+	if err := checkMappedAddr(resp); err != nil {
+		return nil, err
+	}
 	return resp, err
 }
 
+// checkMappedAddr fails a response without a mapped address, which the
+// tests compare. An error response has none either.
+func checkMappedAddr(resp *response) error {
+	if resp != nil && resp.mappedAddr == nil {
+		return errors.New("Server error: no mapped address")
+	}
+	return nil
+}
+
 // Make sure IP and port  have or haven't change
 func addrCompare(host *Host, addr *net.UDPAddr, IPChange, portChange bool) bool {
 	isIPChange := host.IP() != addr.IP.String()
@@ -58,10 +71,33 @@ func (c *Client) test1(conn net.PacketConn, addr net.Addr) (*response, error) {
 	return c.sendBindingReq(conn, addr, false, false)
 }
 
-func (c *Client) test2(conn net.PacketConn, addr net.Addr) (*response, error) {
-	return c.sendBindingReq(conn, addr, true, true)
-}
-
-func (c *Client) test3(conn net.PacketConn, addr net.Addr) (*response, error) {
-	return c.sendBindingReq(conn, addr, false, true)
+// runTest performs a test of the discovery process and records it in result.
+func (c *Client) runTest(result *DiscoveryResult, name string, conn net.PacketConn, addr *net.UDPAddr, changeIP bool, changePort bool) (*response, error) {
+	c.logger.Log(LevelDebug, "test started", "test", name, "to", addr,
+		"change_ip", changeIP, "change_port", changePort)
+	resp, err := c.sendBindingReq(conn, addr, changeIP, changePort)
+	if err != nil {
+		return nil, err
+	}
+	test := TestResult{
+		Name:       name,
+		Dest:       newHostFromUDPAddr(addr),
+		ChangeIP:   changeIP,
+		ChangePort: changePort,
+		Attempts:   c.numRetransmit,
+	}
+	if resp != nil {
+		test.Attempts = resp.attempts
+		test.RTT = resp.rtt
+		test.Responded = true
+		test.ServerAddr = resp.serverAddr
+		test.MappedAddr = resp.mappedAddr
+		test.OtherAddr = resp.otherAddr
+		test.ChangedAddr = resp.changedAddr
+	}
+	result.Tests = append(result.Tests, test)
+	if err := checkMappedAddr(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
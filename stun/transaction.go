@@ -0,0 +1,203 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// transactions routes received STUN responses to the requests waiting for
+// them, by transaction ID.
+//
+// The socket of a DemuxConn is read by the DemuxConn. Any other socket is
+// read by a single goroutine of its transaction table, which only runs while
+// a transaction is pending, so that the socket can be read by its owner
+// between transactions.
+type transactions struct {
+	mu      sync.Mutex
+	pending map[string]*waiter
+	state   *readState
+	conn    net.PacketConn // read on demand, nil if read by someone else
+	reading bool
+}
+
+// waiter is a pending transaction.
+type waiter struct {
+	ch     chan *inbound
+	accept func(*packet, net.Addr) bool // nil to accept any response
+}
+
+// inbound is a response received for a pending transaction.
+type inbound struct {
+	pkt  *packet
+	addr net.Addr
+	time time.Time
+}
+
+// readState tells the pending transactions that the socket cannot be read
+// anymore.
+type readState struct {
+	done chan struct{}
+	err  error
+}
+
+// The transaction tables of the sockets read on demand, which exist while a
+// transaction is pending.
+var (
+	tablesMu sync.Mutex
+	tables   = make(map[net.PacketConn]*transactions)
+)
+
+func newTransactions(conn net.PacketConn) *transactions {
+	t := new(transactions)
+	t.pending = make(map[string]*waiter)
+	t.state = &readState{done: make(chan struct{})}
+	t.conn = conn
+	return t
+}
+
+// startTransaction registers a transaction on conn, whose response is sent
+// to the returned channel, and reads conn if no one is reading it. Responses
+// rejected by accept are dropped, unless it is nil.
+func startTransaction(conn net.PacketConn, id []byte, accept func(*packet, net.Addr) bool) (*transactions, chan *inbound, *readState) {
+	if d, ok := conn.(*DemuxConn); ok {
+		ch, state := d.transactions.add(id, accept)
+		return d.transactions, ch, state
+	}
+	tablesMu.Lock()
+	defer tablesMu.Unlock()
+	t := tables[conn]
+	if t == nil {
+		t = newTransactions(conn)
+		tables[conn] = t
+	}
+	ch, state := t.add(id, accept)
+	return t, ch, state
+}
+
+// add registers a transaction. Only the first response is kept.
+func (t *transactions) add(id []byte, accept func(*packet, net.Addr) bool) (chan *inbound, *readState) {
+	ch := make(chan *inbound, 1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[string(id)] = &waiter{ch, accept}
+	if t.conn != nil && !t.reading {
+		t.reading = true
+		t.state = &readState{done: make(chan struct{})}
+		go t.read(t.state)
+	}
+	return ch, t.state
+}
+
+// remove unregisters a transaction. When no transaction is pending, the
+// reading goroutine is woken up to stop.
+func (t *transactions) remove(id []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, string(id))
+	if t.conn != nil && t.reading && len(t.pending) == 0 {
+		t.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// read reads the socket until no transaction is pending, or the socket
+// fails.
+func (t *transactions) read(state *readState) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if ok && nerr.Timeout() && t.idle() {
+				return
+			}
+			if !ok || !nerr.Timeout() {
+				t.stop()
+				t.fail(state, err)
+				return
+			}
+			continue
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		t.dispatch(b, addr)
+	}
+}
+
+// idle stops reading if no transaction is pending, and clears the deadline
+// set to wake up the reading otherwise.
+func (t *transactions) idle() bool {
+	tablesMu.Lock()
+	defer tablesMu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conn.SetReadDeadline(time.Time{})
+	if len(t.pending) > 0 {
+		return false
+	}
+	t.reading = false
+	delete(tables, t.conn)
+	return true
+}
+
+func (t *transactions) stop() {
+	tablesMu.Lock()
+	defer tablesMu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reading = false
+	delete(tables, t.conn)
+}
+
+// dispatch delivers b to the transaction it answers, and tells whether it is
+// such a response. The bytes must not be reused by the caller.
+func (t *transactions) dispatch(b []byte, addr net.Addr) bool {
+	// The two most significant bits of a STUN message are zeros, and the
+	// class of a response has the C1 bit set.
+	if len(b) < 20 || b[0]&0xc0 != 0 || binary.BigEndian.Uint16(b)&0x0100 == 0 {
+		return false
+	}
+	t.mu.Lock()
+	w := t.pending[string(b[4:20])]
+	t.mu.Unlock()
+	if w == nil {
+		return false
+	}
+	pkt, err := newPacketFromBytes(b)
+	if err != nil {
+		return false
+	}
+	if w.accept != nil && !w.accept(pkt, addr) {
+		return true
+	}
+	select {
+	case w.ch <- &inbound{pkt: pkt, addr: addr, time: time.Now()}:
+	default: // a retransmitted response
+	}
+	return true
+}
+
+// fail wakes up the transactions waiting on state with err.
+func (t *transactions) fail(state *readState, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state.err == nil {
+		state.err = err
+		close(state.done)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 Cong Ding
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stun
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun/nattest"
+)
+
+func TestConcurrentTransactions(t *testing.T) {
+	n := nattest.NewNetwork()
+	newTestServer(t, n)
+	conn, err := n.ListenPacket("3.0.0.1", 5000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+	c := newTestClient(conn)
+
+	servers := []string{"1.0.0.1:3478", "1.0.0.1:3479", "1.0.0.2:3478", "1.0.0.2:3479"}
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			addr, _ := net.ResolveUDPAddr("udp", server)
+			resp, err := c.sendBindingReq(conn, addr, false, false)
+			if err != nil || resp == nil {
+				t.Errorf("Transaction error: %v %v", resp, err)
+				return
+			}
+			if resp.serverAddr.String() != server || resp.mappedAddr.String() != "3.0.0.1:5000" {
+				t.Errorf("Transaction error: response from %v for %v", resp.serverAddr, server)
+			}
+		}(servers[i%len(servers)])
+	}
+	wg.Wait()
+
+	// Once no transaction is pending, the socket belongs to its owner again.
+	peer, err := n.ListenPacket("3.0.0.2", 6000)
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer peer.Close()
+	time.Sleep(10 * time.Millisecond)
+	tablesMu.Lock()
+	if len(tables) != 0 {
+		t.Errorf("Transaction error: %d tables left", len(tables))
+	}
+	tablesMu.Unlock()
+	peer.WriteTo([]byte("data"), conn.LocalAddr())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 10)
+	if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "data" {
+		t.Errorf("ReadFrom error: %q %v", buf[:n], err)
+	}
+}